@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CacheDir returns the directory of the persistent cache, it is
+// $XDG_CACHE_HOME/gx-update-helper, or the equivalent for the OS.
+func CacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gx-update-helper"), nil
+}
+
+// cacheVersion is the version of the format of the cache entries,
+// entries of any other version are ignored and replaced
+const cacheVersion = 1
+
+type cacheEntry struct {
+	Version int
+	Package *PackageFile
+}
+
+// CacheSource keeps a persistent cache of the packages read by the
+// gx backend.  As a gx hash is the hash of the package contents the
+// metadata of a hash never changes.  Only the name, version,
+// dvcsimport and deps. are kept.  The root package is never cached.
+type CacheSource struct {
+	PackageSource
+	Dir string
+}
+
+// NewCacheSource returns src with a persistent cache, if the location
+// of the cache can not be determined src is returned as is.
+func NewCacheSource(src PackageSource) PackageSource {
+	dir, err := CacheDir()
+	if err != nil {
+		return src
+	}
+	return &CacheSource{PackageSource: src, Dir: filepath.Join(dir, "gx")}
+}
+
+func (c *CacheSource) file(hash Hash) string {
+	return filepath.Join(c.Dir, string(hash)+".json")
+}
+
+func (c *CacheSource) Package(hash Hash, name string) (*PackageFile, error) {
+	if hash == "" || strings.ContainsAny(string(hash), `/\`) {
+		return c.PackageSource.Package(hash, name)
+	}
+	fn := c.file(hash)
+	if bytes, err := ioutil.ReadFile(fn); err == nil {
+		entry := cacheEntry{}
+		if json.Unmarshal(bytes, &entry) == nil && entry.Version == cacheVersion &&
+			entry.Package != nil && entry.Package.Name != "" {
+			return entry.Package, nil
+		}
+		// otherwise ignore the bad, or older, entry and replace it
+	}
+	pkg, err := c.PackageSource.Package(hash, name)
+	if err != nil {
+		return nil, err
+	}
+	entry := cacheEntry{cacheVersion, &PackageFile{Name: pkg.Name, Version: pkg.Version, Gx: pkg.Gx}}
+	for _, dep := range pkg.GxDependencies {
+		entry.Package.GxDependencies = append(entry.Package.GxDependencies, PackageDep{Hash: dep.Hash, Name: dep.Name})
+	}
+	bytes, err := json.Marshal(entry)
+	if err == nil && os.MkdirAll(c.Dir, 0755) == nil {
+		// failing to write the cache is not an error
+		WriteFileAtomic(fn, bytes, 0644, true)
+	}
+	return pkg, nil
+}
+
+// CacheStats returns the number of entries in the cache in dir and
+// their total size
+func CacheStats(dir string) (entries int, size int64, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ".json") {
+			entries++
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readsSource counts the packages read from the underlying source
+type readsSource struct {
+	PackageSource
+	reads map[Hash]int
+}
+
+func (src *readsSource) Package(hash Hash, name string) (*PackageFile, error) {
+	src.reads[hash]++
+	return src.PackageSource.Package(hash, name)
+}
+
+func TestCacheSource(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	mem := testSource(diamond)
+	for hash, pkg := range mem.Packages {
+		// a package without a version is still cached
+		if hash != "QmB" {
+			pkg.Version = "1.0.0"
+		}
+	}
+	src := &readsSource{mem, map[Hash]int{}}
+	cache, ok := NewCacheSource(src).(*CacheSource)
+	if !ok {
+		t.Fatal("no cache")
+	}
+	get := func(hash Hash, reads int) {
+		t.Helper()
+		pkg, err := cache.Package(hash, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := mem.Packages[hash]
+		if pkg.Name != exp.Name || pkg.Version != exp.Version || pkg.Gx.Dvcsimport != exp.Gx.Dvcsimport ||
+			len(pkg.GxDependencies) != len(exp.GxDependencies) {
+			t.Errorf("%s: got %+v, expected %+v", hash, pkg, exp)
+		}
+		if src.reads[hash] != reads {
+			t.Errorf("%s: read %d times, expected %d", hash, src.reads[hash], reads)
+		}
+	}
+
+	get("QmA", 1) // miss
+	get("QmA", 1) // hit
+	get("QmC", 1)
+	get("QmB", 1)
+	get("QmB", 1)
+	// the root is never cached
+	get("", 1)
+	get("", 2)
+
+	entries, _, err := CacheStats(cache.Dir)
+	if err != nil || entries != 3 {
+		t.Errorf("got %d entries (%v), expected 3", entries, err)
+	}
+
+	// a corrupted entry, and ones in an older format, are read again
+	// and replaced
+	for hash, data := range map[Hash]string{
+		"QmA": `{"Name": "A"`,
+		"QmB": `{"Name": "B", "Version": "1.0.0"}`,
+		"QmC": `{"Version": 1}`,
+	} {
+		if err := ioutil.WriteFile(cache.file(hash), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get("QmA", 2)
+	get("QmA", 2)
+	get("QmB", 2)
+	get("QmB", 2)
+	get("QmC", 2)
+	get("QmC", 2)
+
+	// errors are not cached
+	if _, err := cache.Package("QmNoSuch", "nosuch"); err == nil {
+		t.Errorf("expected error for a missing package")
+	}
+	if _, err := os.Stat(cache.file("QmNoSuch")); !os.IsNotExist(err) {
+		t.Errorf("missing package cached")
+	}
+}
+
+func TestCacheCmd(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dir, err := CacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stats and clear work without a cache
+	for _, what := range []string{"stats", "clear"} {
+		if err := cacheCmd.Exec([]string{what}); err != nil {
+			t.Errorf("%s without a cache: %s", what, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "gx"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"QmA.json", "QmB.json", "other"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "gx", fn), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, size, err := CacheStats(dir)
+	if err != nil || entries != 2 || size != 4 {
+		t.Errorf("got %d entries of %d bytes (%v), expected 2 of 4 bytes", entries, size, err)
+	}
+	if err := cacheCmd.Exec([]string{"stats"}); err != nil {
+		t.Error(err)
+	}
+	if err := cacheCmd.Exec([]string{"clear"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("cache not removed by clear")
+	}
+	if err := cacheCmd.Exec([]string{"nosuch"}); err == nil {
+		t.Errorf("expected usage error")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// UsageWords returns the option names of c and the literal arguments
+// it accepts
+func (c *Command) UsageWords() (opts []string, words []string) {
+	for _, o := range c.Opts {
+		opts = append(opts, o.names()...)
+	}
+	args := strings.NewReplacer("[", " ", "]", " ", "|", " ").Replace(c.Args)
+	for _, field := range strings.Fields(args) {
+		if strings.ContainsAny(field, "<>") || strings.HasSuffix(field, "...") || field == "--" {
+			continue
+		}
+		words = append(words, field)
+	}
+	return
+}
+
+// completeWords returns the extra words to complete for a command and
+// the dynamic words, given as a __complete argument, if any
+func completeWords(c *Command) (words []string, dynamic string) {
+	_, words = c.UsageWords()
+	switch c.Name {
+	case "list", "exec":
+		dynamic = "conds"
+	case "log":
+		words = append(words, LogEvents...)
+	}
+	return
+}
+
+// CompleteValues returns the values for the dynamic completions.  The
+// state file is read without locking as it is always replaced
+// atomically.
+func CompleteValues(what string) ([]string, error) {
+	state, err := ReadStateFile()
+	if err != nil {
+		return nil, err
+	}
+	vals := NameSet{}
+	switch what {
+	case "pkgs":
+		for _, todo := range state.Todo {
+			vals.Add(todo.Key())
+		}
+	case "keys", "conds":
+		for key := range state.Defaults {
+			vals.Add(key)
+		}
+		for _, todo := range state.Todo {
+			for key := range todo.Meta {
+				vals.Add(key)
+			}
+		}
+		if what == "conds" {
+			// ready and published are already in the usage
+			vals.Add("invalidated")
+		}
+	default:
+		return nil, fmt.Errorf("unknown completion: %s", what)
+	}
+	res := make([]string, 0, len(vals))
+	for val := range vals {
+		res = append(res, val)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func visibleCmds() []*Command {
+	res := []*Command{}
+	for _, c := range cmds {
+		if !c.Hidden {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+func CompletionBash(prog string) string {
+	var buf bytes.Buffer
+	fn := "_" + strings.Replace(filepath.Base(prog), "-", "_", -1)
+	names := []string{}
+	for _, c := range visibleCmds() {
+		names = append(names, c.Name)
+	}
+	fmt.Fprintf(&buf, `%s() {
+  local cur prev words
+  cur="${COMP_WORDS[COMP_CWORD]}"
+  prev="${COMP_WORDS[COMP_CWORD-1]}"
+  if [ "$COMP_CWORD" -eq 1 ]; then
+    COMPREPLY=($(compgen -W "%s -h --help" -- "$cur"))
+    return
+  fi
+  case "$prev" in
+    -p|--pkg)
+      COMPREPLY=($(compgen -W "$(%s __complete pkgs 2>/dev/null)" -- "$cur"))
+      return
+      ;;
+    -f|--format)
+      return
+      ;;
+  esac
+  case "${COMP_WORDS[1]}" in
+`, fn, strings.Join(names, " "), shellQuote(prog))
+	for _, c := range visibleCmds() {
+		opts, _ := c.UsageWords()
+		words, dynamic := completeWords(c)
+		fmt.Fprintf(&buf, "    %s)\n", c.Name)
+		if c.Name == "meta" {
+			fmt.Fprintf(&buf, `      case "$prev" in
+        get|set|unset)
+          COMPREPLY=($(compgen -W "$(%s __complete keys 2>/dev/null)" -- "$cur"))
+          return
+          ;;
+      esac
+`, shellQuote(prog))
+		}
+		fmt.Fprintf(&buf, "      words=\"%s\"\n", strings.Join(append(opts, words...), " "))
+		if dynamic != "" {
+			fmt.Fprintf(&buf, "      words=\"$words $(%s __complete %s 2>/dev/null)\"\n", shellQuote(prog), dynamic)
+		}
+		buf.WriteString("      ;;\n")
+	}
+	fmt.Fprintf(&buf, `  esac
+  COMPREPLY=($(compgen -W "$words --help" -- "$cur"))
+}
+complete -F %s %s
+`, fn, filepath.Base(prog))
+	return buf.String()
+}
+
+func CompletionZsh(prog string) string {
+	var buf bytes.Buffer
+	base := filepath.Base(prog)
+	fn := "_" + strings.Replace(base, "-", "_", -1)
+	fmt.Fprintf(&buf, "#compdef %s\n\n%s() {\n", base, fn)
+	buf.WriteString("  local -a cmds\n  cmds=(\n")
+	for _, c := range visibleCmds() {
+		fmt.Fprintf(&buf, "    %s\n", shellQuote(c.Name+":"+strings.Replace(c.Tagline, ":", `\:`, -1)))
+	}
+	buf.WriteString("  )\n")
+	fmt.Fprintf(&buf, `  if (( CURRENT == 2 )); then
+    _describe 'command' cmds
+    return
+  fi
+  local prev=${words[CURRENT-1]}
+  if [[ $prev == (-p|--pkg) ]]; then
+    compadd -- ${(f)"$(%[1]s __complete pkgs 2>/dev/null)"}
+    return
+  fi
+  if [[ $prev == (-f|--format) ]]; then
+    return
+  fi
+  case ${words[2]} in
+`, shellQuote(prog))
+	for _, c := range visibleCmds() {
+		opts, _ := c.UsageWords()
+		words, dynamic := completeWords(c)
+		fmt.Fprintf(&buf, "    %s)\n", c.Name)
+		if c.Name == "meta" {
+			fmt.Fprintf(&buf, `      if [[ $prev == (get|set|unset) ]]; then
+        compadd -- ${(f)"$(%s __complete keys 2>/dev/null)"}
+        return
+      fi
+`, shellQuote(prog))
+		}
+		all := append(opts, words...)
+		all = append(all, "--help")
+		fmt.Fprintf(&buf, "      compadd -- %s\n", strings.Join(all, " "))
+		if dynamic != "" {
+			fmt.Fprintf(&buf, "      compadd -- ${(f)\"$(%s __complete %s 2>/dev/null)\"}\n", shellQuote(prog), dynamic)
+		}
+		buf.WriteString("      ;;\n")
+	}
+	// the file is autoloaded as the completion function so it must
+	// also call it
+	fmt.Fprintf(&buf, "  esac\n}\n\n%s \"$@\"\n", fn)
+	return buf.String()
+}
+
+func CompletionFish(prog string) string {
+	var buf bytes.Buffer
+	base := filepath.Base(prog)
+	complete := "complete -c " + base
+	fmt.Fprintf(&buf, "%s -f\n", complete)
+	for _, c := range visibleCmds() {
+		fmt.Fprintf(&buf, "%s -n __fish_use_subcommand -a %s -d %s\n", complete, c.Name, shellQuote(c.Tagline))
+	}
+	for _, c := range visibleCmds() {
+		cond := shellQuote("__fish_seen_subcommand_from " + c.Name)
+		words, dynamic := completeWords(c)
+		for _, o := range c.Opts {
+			line := complete + " -n " + cond
+			if o.Short != "" {
+				line += " -s " + o.Short
+			}
+			if o.Long != "" {
+				line += " -l " + o.Long
+			}
+			if o.Type != FlagOpt {
+				line += " -x"
+			}
+			if o.Long == "pkg" {
+				line += " -a " + shellQuote(fmt.Sprintf("(%s __complete pkgs 2>/dev/null)", prog))
+			}
+			fmt.Fprintf(&buf, "%s -d %s\n", line, shellQuote(o.Help))
+		}
+		if c.Name == "meta" {
+			fmt.Fprintf(&buf, "%s -n %s -a %s\n", complete,
+				shellQuote("__fish_seen_subcommand_from meta; and __fish_seen_subcommand_from get set unset"),
+				shellQuote(fmt.Sprintf("(%s __complete keys 2>/dev/null)", prog)))
+		}
+		if len(words) > 0 {
+			fmt.Fprintf(&buf, "%s -n %s -a %s\n", complete, cond, shellQuote(strings.Join(words, " ")))
+		}
+		if dynamic != "" {
+			fmt.Fprintf(&buf, "%s -n %s -a %s\n", complete, cond,
+				shellQuote(fmt.Sprintf("(%s __complete %s 2>/dev/null)", prog, dynamic)))
+		}
+	}
+	return buf.String()
+}
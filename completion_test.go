@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompletionCmds(t *testing.T) {
+	bash := CompletionBash("gx-update-helper")
+	// the list of commands completed for the first word
+	i := strings.Index(bash, `compgen -W "`)
+	j := strings.Index(bash, ` -h --help"`)
+	if i == -1 || j < i {
+		t.Fatalf("bash: no list of commands")
+	}
+	bashCmds := " " + bash[i+len(`compgen -W "`):j] + " "
+	scripts := []struct {
+		shell  string
+		script string
+		// the strings that must be in the script for each command
+		expected []string
+	}{
+		{"bash", bash, []string{"\n    %s)\n"}},
+		{"bash", bashCmds, []string{" %s "}},
+		{"zsh", CompletionZsh("gx-update-helper"), []string{"\n    '%s:", "\n    %s)\n"}},
+		{"fish", CompletionFish("gx-update-helper"), []string{" -a %s -d "}},
+	}
+	for _, s := range scripts {
+		for _, c := range cmds {
+			for _, str := range s.expected {
+				str = strings.Replace(str, "%s", c.Name, 1)
+				found := strings.Contains(s.script, str)
+				if found && c.Hidden {
+					t.Errorf("%s: hidden command %s included", s.shell, c.Name)
+				} else if !found && !c.Hidden {
+					t.Errorf("%s: %s: %q not found", s.shell, c.Name, str)
+				}
+			}
+		}
+	}
+	if zsh := CompletionZsh("gx-update-helper"); !strings.HasSuffix(zsh, "\n_gx_update_helper \"$@\"\n") {
+		t.Errorf("zsh: the completion function is not called when autoloaded")
+	}
+}
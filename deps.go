@@ -3,21 +3,108 @@ package main
 import (
 	"fmt"
 	"sort"
+	"strings"
 )
 
-func (pkgs Packages) ByName(name string) *PkgInfo {
+// ByName returns all versions of the package with the given name
+// sorted by hash
+func (pkgs Packages) ByName(name string) []*PkgInfo {
+	res := []*PkgInfo{}
 	for _, pkg := range pkgs {
 		if pkg.Name == name {
-			return pkg
+			res = append(res, pkg)
 		}
 	}
-	return nil
+	sort.Slice(res, func(i, j int) bool { return res[i].Hash < res[j].Hash })
+	return res
+}
+
+// sameHash returns true if sel is hash or, for a go module, the
+// version in hash
+func sameHash(hash Hash, sel string) bool {
+	_, version := SplitModHash(hash)
+	return string(hash) == sel || version != "" && version == sel
 }
 
-func (pkgs Packages) Names(hashes []Hash) []string {
+// hashHasPrefix returns true if sel is a prefix of hash or, for a go
+// module, the leading components of the version in hash, so that v1.1
+// matches v1.1.2 but not v1.10.0
+func hashHasPrefix(hash Hash, sel string) bool {
+	_, version := SplitModHash(hash)
+	return strings.HasPrefix(string(hash), sel) || version != "" && strings.HasPrefix(version, sel+".")
+}
+
+// Select returns the packages matching sel.  If sel is a name there
+// must only be a single version of the package, otherwise a specific
+// version can be selected using <name>@<hash> where <hash> can be a
+// prefix, and all versions using <name>@all.  For go modules <hash>
+// can also be the version, or its leading components as in
+// <path>@v1.2.
+func (pkgs Packages) Select(sel string) ([]*PkgInfo, error) {
+	name, hash := sel, ""
+	found := pkgs.ByName(sel)
+	if len(found) == 0 {
+		if i := strings.IndexByte(sel, '@'); i != -1 {
+			name, hash = sel[:i], sel[i+1:]
+			found = pkgs.ByName(name)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("package not found: %s", name)
+	}
+	switch hash {
+	case "all":
+		return found, nil
+	case "":
+		if len(found) == 1 {
+			return found, nil
+		}
+		vers := make([]string, len(found))
+		for i, pkg := range found {
+			vers[i] = fmt.Sprintf("%s@%s", pkg.Name, pkg.Hash)
+		}
+		return nil, fmt.Errorf("multiple versions of %s found, use <name>@<hash> to select one or %s@all to select all:\n  %s",
+			name, name, strings.Join(vers, "\n  "))
+	}
+	res := []*PkgInfo{}
+	for _, pkg := range found {
+		if sameHash(pkg.Hash, hash) {
+			return []*PkgInfo{pkg}, nil
+		}
+		if hashHasPrefix(pkg.Hash, hash) {
+			res = append(res, pkg)
+		}
+	}
+	if len(res) != 1 {
+		return nil, fmt.Errorf("%s: no unique version matching hash %s", name, hash)
+	}
+	return res, nil
+}
+
+// Ids returns the ids to use for the todo entries of hashes.  The id
+// is just the name unless there is more than one version of a package,
+// in which case it is <name>@<hash>.
+func (pkgs Packages) Ids(hashes []Hash) map[Hash]string {
+	count := map[string]int{}
+	for _, hash := range hashes {
+		count[pkgs[hash].Name]++
+	}
+	ids := map[Hash]string{}
+	for _, hash := range hashes {
+		name := pkgs[hash].Name
+		if count[name] > 1 {
+			ids[hash] = fmt.Sprintf("%s@%s", name, hash)
+		} else {
+			ids[hash] = name
+		}
+	}
+	return ids
+}
+
+func Names(ids map[Hash]string, hashes []Hash) []string {
 	names := make([]string, len(hashes))
 	for i, hash := range hashes {
-		names[i] = pkgs[hash].Name
+		names[i] = ids[hash]
 	}
 	sort.Strings(names)
 	return names
@@ -33,23 +120,42 @@ func (pkgs Packages) Dump() {
 	}
 }
 
-func GatherDeps(pkgs Packages, root Hash, pkgDir string) (*PkgInfo, error) {
+// Number of packages read at once by GatherDeps
+var gatherWorkers = 16
+
+// GatherDeps gathers root and all its deps. into pkgs.  The packages
+// are first read in parallel and then walked in the same order as
+// when reading them one at a time so that the result, including any
+// error, does not depend on the order they were read in.
+func GatherDeps(src PackageSource, pkgs Packages, root Hash, name string) (*PkgInfo, error) {
 	if pkgs[root] != nil {
 		return pkgs[root], nil // already processed
 	}
-	jsonPkg, err := ReadPackage(pkgDir)
+	return gatherDeps(Prefetch(src, root, name, gatherWorkers), pkgs, root, name)
+}
+
+func gatherDeps(src PackageSource, pkgs Packages, root Hash, name string) (*PkgInfo, error) {
+	if pkgs[root] != nil {
+		return pkgs[root], nil // already processed
+	}
+	jsonPkg, err := src.Package(root, name)
 	if err != nil {
 		return nil, err
 	}
 	pkg := &PkgInfo{
 		Hash:       root,
 		Name:       jsonPkg.Name,
+		Version:    jsonPkg.Version,
 		Path:       jsonPkg.Gx.Dvcsimport,
+		Dir:        jsonPkg.Dir,
 		Deps:       Packages{},
 		DirectDeps: Packages{},
 	}
+	// register early so that a dependency cycle does not cause
+	// infinite recursion, BubbleList will detect the cycle
+	pkgs[root] = pkg
 	for _, dep := range jsonPkg.GxDependencies {
-		depPkg, err := GatherDeps(pkgs, dep.Hash, GxDir(dep.Hash, dep.Name))
+		depPkg, err := gatherDeps(src, pkgs, dep.Hash, dep.Name)
 		if err != nil {
 			return nil, err
 		}
@@ -60,10 +166,38 @@ func GatherDeps(pkgs Packages, root Hash, pkgDir string) (*PkgInfo, error) {
 			pkg.Deps[subdep.Hash] = subdep
 		}
 	}
-	pkgs[root] = pkg
 	return pkg, nil
 }
 
+// FixClosure recomputes the transitive closure of all deps.  The
+// closure computed by GatherDeps will be incomplete if there are
+// dependency cycles.
+func (pkgs Packages) FixClosure() {
+	for _, pkg := range pkgs {
+		deps := Packages{}
+		queue := []*PkgInfo{pkg}
+		for len(queue) > 0 {
+			cur := queue[0]
+			queue = queue[1:]
+			for hash, dep := range cur.DirectDeps {
+				if deps[hash] == nil {
+					deps[hash] = dep
+					queue = append(queue, dep)
+				}
+			}
+		}
+		pkg.Deps = deps
+	}
+}
+
+func (pkgs Packages) All() DepSet {
+	all := DepSet{}
+	for hash, _ := range pkgs {
+		all.Add(hash)
+	}
+	return all
+}
+
 func (pkgs Packages) RevDeps(hash Hash) DepSet {
 	revDeps := DepSet{}
 	for dephash, dep := range pkgs {
@@ -90,13 +224,232 @@ type RevDep struct {
 	DirectDeps   []Hash // Deps to update that depend on previous level
 	AlsoUpdate   []Hash // Deps that also need to be updated
 	IndirectDeps []Hash //
+	Targets      []Hash // Targets that caused this dep to be included
+}
+
+// Targets returns the subset of targets that are either hash itself
+// or one of its (transitive) deps
+func (pkgs Packages) Targets(hash Hash, targets []Hash) []Hash {
+	res := []Hash{}
+	for _, target := range targets {
+		if target == hash || pkgs[hash].Deps[target] != nil {
+			res = append(res, target)
+		}
+	}
+	return res
+}
+
+// PathString formats a path through the dep. graph
+func (pkgs Packages) PathString(path []Hash) string {
+	strs := make([]string, len(path))
+	for i, hash := range path {
+		if hash == "" {
+			strs[i] = pkgs[hash].Name
+		} else {
+			strs[i] = fmt.Sprintf("%s (%s)", pkgs[hash].Name, hash)
+		}
+	}
+	return strings.Join(strs, " -> ")
+}
+
+// Paths returns the paths from hash to any of the targets following
+// the direct deps.  As the number of paths can grow exponentially
+// with the depth of the graph at most limit paths are returned, more
+// is true if there are others.
+func (pkgs Packages) Paths(hash Hash, targets []Hash, limit int) (paths [][]Hash, more bool) {
+	isTarget := DepSet{}
+	isTarget.Add(targets...)
+	// only follow deps. that lead to a target
+	leadsTo := func(pkg *PkgInfo) bool {
+		if isTarget.Has(pkg.Hash) {
+			return true
+		}
+		for _, target := range targets {
+			if pkg.Deps[target] != nil {
+				return true
+			}
+		}
+		return false
+	}
+	paths = [][]Hash{}
+	path := []Hash{}
+	var walk func(pkg *PkgInfo)
+	walk = func(pkg *PkgInfo) {
+		if more {
+			return
+		}
+		path = append(path, pkg.Hash)
+		defer func() { path = path[:len(path)-1] }()
+		if isTarget.Has(pkg.Hash) {
+			if len(paths) == limit {
+				more = true
+				return
+			}
+			paths = append(paths, append([]Hash(nil), path...))
+		}
+		deps := []*PkgInfo{}
+		for _, dep := range pkg.DirectDeps {
+			if leadsTo(dep) {
+				deps = append(deps, dep)
+			}
+		}
+		sort.Slice(deps, func(i, j int) bool { return deps[i].Name < deps[j].Name })
+		for _, dep := range deps {
+			walk(dep)
+		}
+	}
+	walk(pkgs[hash])
+	return
 }
 
-func BubbleList(pkgs Packages, hash Hash) []RevDep {
-	// Start by getting the rev deps for the hash
+// ShortestPath returns the shortest path from hash to any of the
+// targets following the direct deps., or nil if there is none.
+func (pkgs Packages) ShortestPath(hash Hash, targets []Hash) []Hash {
+	isTarget := DepSet{}
+	isTarget.Add(targets...)
+	prev := map[Hash]Hash{hash: hash}
+	queue := []Hash{hash}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if isTarget.Has(cur) {
+			path := []Hash{cur}
+			for cur != hash {
+				cur = prev[cur]
+				path = append([]Hash{cur}, path...)
+			}
+			return path
+		}
+		deps := []Hash{}
+		for dep := range pkgs[cur].DirectDeps {
+			deps = append(deps, dep)
+		}
+		sort.Slice(deps, func(i, j int) bool { return pkgs[deps[i]].Name < pkgs[deps[j]].Name })
+		for _, dep := range deps {
+			if _, ok := prev[dep]; !ok {
+				prev[dep] = cur
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return nil
+}
+
+type CycleError struct {
+	Pkgs   Packages
+	Cycles [][]Hash
+}
+
+func (e CycleError) Error() string {
+	strs := make([]string, len(e.Cycles))
+	for i, cycle := range e.Cycles {
+		strs[i] = e.Pkgs.PathString(append(cycle, cycle[0]))
+	}
+	return fmt.Sprintf("dependency cycle detected:\n  %s", strings.Join(strs, "\n  "))
+}
+
+// Cycles finds all the dependency cycles among the packages in deps.
+// One cycle is returned for each strongly connected component.
+func (pkgs Packages) Cycles(deps DepSet) [][]Hash {
+	hashes := deps.Elms()
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	edges := func(hash Hash) []Hash {
+		res := pkgs[hash].DirectDeps.Intersect(deps).Elms()
+		sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+		return res
+	}
+	// Tarjan's strongly connected components algorithm
+	index := map[Hash]int{}
+	lowlink := map[Hash]int{}
+	onStack := DepSet{}
+	stack := []Hash{}
+	comps := []DepSet{}
+	var visit func(hash Hash)
+	visit = func(hash Hash) {
+		index[hash] = len(index)
+		lowlink[hash] = index[hash]
+		stack = append(stack, hash)
+		onStack.Add(hash)
+		for _, dep := range edges(hash) {
+			if _, ok := index[dep]; !ok {
+				visit(dep)
+				if lowlink[dep] < lowlink[hash] {
+					lowlink[hash] = lowlink[dep]
+				}
+			} else if onStack.Has(dep) && index[dep] < lowlink[hash] {
+				lowlink[hash] = index[dep]
+			}
+		}
+		if lowlink[hash] != index[hash] {
+			return
+		}
+		comp := DepSet{}
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack.Del(top)
+			comp.Add(top)
+			if top == hash {
+				break
+			}
+		}
+		if comp.Len() > 1 || pkgs[hash].DirectDeps[hash] != nil {
+			comps = append(comps, comp)
+		}
+	}
+	for _, hash := range hashes {
+		if _, ok := index[hash]; !ok {
+			visit(hash)
+		}
+	}
+	// Now find a path through each component back to its start
+	cycles := [][]Hash{}
+	for _, comp := range comps {
+		elms := comp.Elms()
+		sort.Slice(elms, func(i, j int) bool { return elms[i] < elms[j] })
+		start := elms[0]
+		prev := map[Hash]Hash{}
+		queue := []Hash{start}
+		for len(queue) > 0 {
+			hash := queue[0]
+			queue = queue[1:]
+			if _, ok := prev[start]; ok {
+				break
+			}
+			for _, dep := range edges(hash) {
+				if _, ok := prev[dep]; ok || !comp.Has(dep) {
+					continue
+				}
+				prev[dep] = hash
+				queue = append(queue, dep)
+			}
+		}
+		cycle := []Hash{}
+		for hash := prev[start]; hash != start; hash = prev[hash] {
+			cycle = append(cycle, hash)
+		}
+		cycle = append(cycle, start)
+		// reverse so the cycle follows the direction of the deps
+		for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+			cycle[i], cycle[j] = cycle[j], cycle[i]
+		}
+		cycles = append(cycles, cycle)
+	}
+	return cycles
+}
+
+func BubbleList(pkgs Packages, hashes ...Hash) ([]RevDep, error) {
+	// Start by getting the rev deps for each of the hashes and
+	// merging them
 	lst := []RevDep{}
-	deps := pkgs.RevDeps(hash)
-	deps.Add(hash)
+	deps := DepSet{}
+	for _, hash := range hashes {
+		deps.Add(pkgs.RevDeps(hash).Elms()...)
+		deps.Add(hash)
+	}
+	if cycles := pkgs.Cycles(deps); len(cycles) > 0 {
+		return nil, CycleError{pkgs, cycles}
+	}
 	// Now determine which of those packages depends on each other
 	depMap := map[Hash]DepSet{}
 	fullDeps := map[Hash]DepSet{}
@@ -143,6 +496,7 @@ func BubbleList(pkgs Packages, hash Hash) []RevDep {
 				DirectDeps:   pruned,
 				AlsoUpdate:   alsoUpdate,
 				IndirectDeps: indirect.Elms(),
+				Targets:      pkgs.Targets(dephash, hashes),
 			})
 		}
 		level += 1
@@ -152,5 +506,5 @@ func BubbleList(pkgs Packages, hash Hash) []RevDep {
 	for len(next) > 0 {
 		next = iterate(next...)
 	}
-	return lst
+	return lst, nil
 }
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCycles(t *testing.T) {
+	tests := []struct {
+		desc   string
+		graph  map[string][]string
+		cycles [][]Hash
+	}{
+		{"no cycle", diamond, [][]Hash{}},
+		{
+			"simple",
+			map[string][]string{"root": {"A"}, "A": {"B"}, "B": {"A"}},
+			[][]Hash{{"QmA", "QmB"}},
+		},
+		{
+			"self loop",
+			map[string][]string{"root": {"A"}, "A": {"A"}},
+			[][]Hash{{"QmA"}},
+		},
+		{
+			"starts at smallest hash",
+			map[string][]string{"root": {"C"}, "A": {"B"}, "B": {"C"}, "C": {"A"}},
+			[][]Hash{{"QmA", "QmB", "QmC"}},
+		},
+		{
+			"two components",
+			map[string][]string{
+				"root": {"A", "C"},
+				"A":    {"B"}, "B": {"A"},
+				"C": {"D"}, "D": {"E"}, "E": {"C"},
+			},
+			[][]Hash{{"QmA", "QmB"}, {"QmC", "QmD", "QmE"}},
+		},
+		{
+			"shortest path through component",
+			map[string][]string{
+				"root": {"A"},
+				"A":    {"B", "C"}, "B": {"C"}, "C": {"A"},
+			},
+			[][]Hash{{"QmA", "QmC"}},
+		},
+	}
+	for _, test := range tests {
+		pkgs := Packages{}
+		if _, err := GatherDeps(testSource(test.graph), pkgs, "", ""); err != nil {
+			t.Fatalf("%s: %s", test.desc, err)
+		}
+		cycles := pkgs.Cycles(pkgs.All())
+		// components are found in an order that depends on the
+		// traversal so compare them as a set
+		for _, exp := range test.cycles {
+			found := false
+			for _, cycle := range cycles {
+				if reflect.DeepEqual(cycle, exp) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s: cycle %v not found in %v", test.desc, exp, cycles)
+			}
+		}
+		if len(cycles) != len(test.cycles) {
+			t.Errorf("%s: got %d cycles, expected %d", test.desc, len(cycles), len(test.cycles))
+		}
+	}
+}
+
+func TestBubbleListCycle(t *testing.T) {
+	graph := map[string][]string{"root": {"A"}, "A": {"B"}, "B": {"C"}, "C": {"B"}}
+	_, _, err := Gather(testSource(graph), "C")
+	if _, ok := err.(CycleError); !ok {
+		t.Fatalf("expected CycleError got %v", err)
+	}
+	if !strings.Contains(err.Error(), "B (QmB) -> C (QmC) -> B (QmB)") {
+		t.Errorf("unexpected error message: %s", err)
+	}
+}
+
+// countingSource records the most calls to Package running at once
+type countingSource struct {
+	PackageSource
+	mu        sync.Mutex
+	cur, most int
+}
+
+func (src *countingSource) Package(hash Hash, name string) (*PackageFile, error) {
+	src.mu.Lock()
+	src.cur++
+	if src.cur > src.most {
+		src.most = src.cur
+	}
+	src.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	defer func() {
+		src.mu.Lock()
+		src.cur--
+		src.mu.Unlock()
+	}()
+	return src.PackageSource.Package(hash, name)
+}
+
+func TestGatherDepsParallel(t *testing.T) {
+	// a diamond with cycles, and a missing package
+	graph := map[string][]string{
+		"root": {"A", "B"},
+		"A":    {"C", "D"}, "B": {"C", "E"},
+		"C": {"F"}, "D": {"F", "A"},
+		"E": {"B", "G"}, "F": {"C"}, "G": {},
+	}
+	// describe returns the deps. of each package in a form that can
+	// be compared
+	hashes := func(pkgs Packages) string {
+		res := []string{}
+		for hash := range pkgs {
+			res = append(res, string(hash))
+		}
+		sort.Strings(res)
+		return strings.Join(res, " ")
+	}
+	describe := func(pkgs Packages) map[Hash]string {
+		res := map[Hash]string{}
+		for hash, pkg := range pkgs {
+			res[hash] = pkg.Name + ": " + hashes(pkg.DirectDeps) + " :: " + hashes(pkg.Deps)
+		}
+		return res
+	}
+	defer func(workers int) { gatherWorkers = workers }(gatherWorkers)
+	gatherWorkers = 3
+	for _, missing := range []string{"", "G", "F"} {
+		src := testSource(graph)
+		if missing != "" {
+			delete(src.Packages, Hash("Qm"+missing))
+		}
+		serial := Packages{}
+		_, serialErr := gatherDeps(src, serial, "", "")
+		for i := 0; i < 10; i++ {
+			parallel := Packages{}
+			counting := &countingSource{PackageSource: src}
+			_, err := GatherDeps(counting, parallel, "", "")
+			if fmt.Sprint(err) != fmt.Sprint(serialErr) {
+				t.Fatalf("missing %q: got error %v, expected %v", missing, err, serialErr)
+			}
+			if !reflect.DeepEqual(describe(parallel), describe(serial)) {
+				t.Fatalf("missing %q: got %v, expected %v", missing, describe(parallel), describe(serial))
+			}
+			if counting.most > gatherWorkers {
+				t.Errorf("%d packages read at once, expected at most %d", counting.most, gatherWorkers)
+			}
+		}
+	}
+}
+
+func TestPaths(t *testing.T) {
+	pkgs := Packages{}
+	if _, err := GatherDeps(testSource(diamond), pkgs, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	str := func(paths [][]Hash) []string {
+		res := []string{}
+		for _, path := range paths {
+			strs := make([]string, len(path))
+			for i, hash := range path {
+				strs[i] = pkgs[hash].Name
+			}
+			res = append(res, strings.Join(strs, " "))
+		}
+		return res
+	}
+	tests := []struct {
+		from     Hash
+		targets  []Hash
+		paths    []string
+		shortest string
+	}{
+		{"", []Hash{"QmC"}, []string{"root A C", "root B C"}, "root A C"},
+		{"", []Hash{"QmD", "QmC"}, []string{"root A C", "root A D", "root B C"}, "root A C"},
+		{"", []Hash{"QmA", "QmC"}, []string{"root A", "root A C", "root B C"}, "root A"},
+		{"", []Hash{"QmB"}, []string{"root B"}, "root B"},
+		{"QmA", []Hash{"QmD"}, []string{"A D"}, "A D"},
+		{"QmC", []Hash{"QmC"}, []string{"C"}, "C"},
+		{"QmC", []Hash{"QmA"}, []string{}, ""},
+	}
+	for _, test := range tests {
+		paths, more := pkgs.Paths(test.from, test.targets, 10)
+		if got := str(paths); !reflect.DeepEqual(got, test.paths) || more {
+			t.Errorf("%s -> %v: got %q (more %v), expected %q", test.from, test.targets, got, more, test.paths)
+		}
+		shortest := ""
+		if path := pkgs.ShortestPath(test.from, test.targets); path != nil {
+			shortest = str([][]Hash{path})[0]
+		}
+		if shortest != test.shortest {
+			t.Errorf("%s -> %v: got shortest %q, expected %q", test.from, test.targets, shortest, test.shortest)
+		}
+	}
+
+	paths, more := pkgs.Paths("", []Hash{"QmD", "QmC"}, 2)
+	if got := str(paths); !reflect.DeepEqual(got, []string{"root A C", "root A D"}) || !more {
+		t.Errorf("limit 2: got %q (more %v)", got, more)
+	}
+}
+
+func TestPathsWide(t *testing.T) {
+	// 30 levels of two packages each depending on both packages of the
+	// next level, so there are 2^30 paths from the root to T
+	const depth = 30
+	graph := map[string][]string{"T": {}}
+	name := func(level int, i int) string {
+		if level == depth {
+			return "T"
+		}
+		return fmt.Sprintf("L%d-%d", level, i)
+	}
+	graph["root"] = []string{name(0, 0), name(0, 1)}
+	for level := 0; level < depth; level++ {
+		for i := 0; i < 2; i++ {
+			graph[name(level, i)] = []string{name(level+1, 0), name(level+1, 1)}
+		}
+	}
+	pkgs := Packages{}
+	if _, err := GatherDeps(testSource(graph), pkgs, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	paths, more := pkgs.Paths("", []Hash{"QmT"}, 100)
+	if len(paths) != 100 || !more {
+		t.Errorf("got %d paths (more %v), expected 100 and more", len(paths), more)
+	}
+	for _, path := range paths {
+		if len(path) != depth+2 || path[len(path)-1] != "QmT" {
+			t.Fatalf("bad path: %s", pkgs.PathString(path))
+		}
+	}
+	if path := pkgs.ShortestPath("", []Hash{"QmT"}); len(path) != depth+2 {
+		t.Errorf("bad shortest path: %s", pkgs.PathString(path))
+	}
+}
+
+// versionedPkgs has three versions of A, two with a common prefix, and
+// a single version of B
+func versionedPkgs() Packages {
+	pkgs := Packages{}
+	for _, pkg := range []*PkgInfo{
+		{Hash: "QmA1x", Name: "A"},
+		{Hash: "QmA1y", Name: "A"},
+		{Hash: "QmA2", Name: "A"},
+		{Hash: "QmB", Name: "B"},
+	} {
+		pkgs[pkg.Hash] = pkg
+	}
+	return pkgs
+}
+
+func TestSelect(t *testing.T) {
+	pkgs := versionedPkgs()
+	if found := pkgs.ByName("A"); len(found) != 3 || found[0].Hash != "QmA1x" || found[2].Hash != "QmA2" {
+		t.Errorf("ByName(A): got %v", found)
+	}
+	if found := pkgs.ByName("C"); len(found) != 0 {
+		t.Errorf("ByName(C): got %v", found)
+	}
+	tests := []struct {
+		sel    string
+		hashes []Hash // nil if an error is expected
+	}{
+		{"B", []Hash{"QmB"}},
+		{"B@QmB", []Hash{"QmB"}},
+		{"B@Qm", []Hash{"QmB"}},
+		{"A@QmA2", []Hash{"QmA2"}},
+		{"A@QmA1y", []Hash{"QmA1y"}},
+		{"A@all", []Hash{"QmA1x", "QmA1y", "QmA2"}},
+		{"B@all", []Hash{"QmB"}},
+		// ambiguous
+		{"A", nil},
+		{"A@QmA1", nil},
+		{"A@Qm", nil},
+		// not found
+		{"C", nil},
+		{"C@QmC", nil},
+		{"A@QmB", nil},
+		{"A@", nil},
+	}
+	for _, test := range tests {
+		found, err := pkgs.Select(test.sel)
+		if test.hashes == nil {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", test.sel, found)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.sel, err)
+			continue
+		}
+		hashes := []Hash{}
+		for _, pkg := range found {
+			hashes = append(hashes, pkg.Hash)
+		}
+		if !reflect.DeepEqual(hashes, test.hashes) {
+			t.Errorf("%s: got %v, expected %v", test.sel, hashes, test.hashes)
+		}
+	}
+	// the error for an ambiguous name lists the versions
+	_, err := pkgs.Select("A")
+	if err == nil || !strings.Contains(err.Error(), "A@QmA1x") || !strings.Contains(err.Error(), "A@QmA2") {
+		t.Errorf("A: unexpected error: %v", err)
+	}
+}
+
+func TestIds(t *testing.T) {
+	pkgs := versionedPkgs()
+	ids := pkgs.Ids([]Hash{"QmA1x", "QmA2", "QmB"})
+	expected := map[Hash]string{"QmA1x": "A@QmA1x", "QmA2": "A@QmA2", "QmB": "B"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("got %v, expected %v", ids, expected)
+	}
+	// only the versions given count
+	ids = pkgs.Ids([]Hash{"QmA2", "QmB"})
+	expected = map[Hash]string{"QmA2": "A", "QmB": "B"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("got %v, expected %v", ids, expected)
+	}
+}
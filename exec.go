@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Env returns the variables of the package as environment variables,
+// named GXU_<KEY>, for use by commands run by 'exec'.  Variables that
+// are not defined for the package, or give an error, are left out.
+func (v *Todo) Env() []string {
+	keys := []string{}
+	for _, kd := range AllKeys {
+		if !kd.Unused {
+			keys = append(keys, kd.Name)
+		}
+	}
+	for key := range v.defaults {
+		keys = append(keys, key)
+	}
+	for key := range v.Meta {
+		keys = append(keys, key)
+	}
+	env := []string{}
+	seen := NameSet{}
+	for _, key := range keys {
+		name := envName(key)
+		if seen.Has(name) {
+			continue
+		}
+		seen.Add(name)
+		val, have, err := v.Get(key)
+		if err != nil || !have {
+			continue
+		}
+		env = append(env, name+"="+val)
+	}
+	return env
+}
+
+func envName(key string) string {
+	name := []byte("GXU_" + strings.ToUpper(key))
+	for i, c := range name {
+		if !('A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// ExecResult is the result of running a command for a package
+type ExecResult struct {
+	Todo   *Todo
+	Err    error
+	Output []byte // only when run concurrently
+}
+
+// IsFormatArg returns true if arg is formatted by ExecCmd.  Only
+// arguments with a '${' are formatted so that other arguments, such as
+// a pattern containing a '[' or '|' or a shell command using $HOME,
+// are passed as is.
+func IsFormatArg(arg string) bool {
+	return strings.Contains(arg, "${")
+}
+
+// ExecCmd runs the command in argv for todo in its directory.  The
+// format variables in the arguments of argv with a '${' are expanded.
+// If buffer is true the output is collected in the result, otherwise
+// it goes to stdout and stderr.
+func ExecCmd(todo *Todo, argv []string, buffer bool) (res ExecResult) {
+	res.Todo = todo
+	cmdArgs := make([]string, 0, len(argv))
+	for _, arg := range argv {
+		if !IsFormatArg(arg) {
+			cmdArgs = append(cmdArgs, arg)
+			continue
+		}
+		str, err := todo.Format(arg)
+		if err != nil {
+			res.Err = err
+			return
+		}
+		cmdArgs = append(cmdArgs, string(str))
+	}
+	dir, _ := todo.LocalDir()
+	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), todo.Env()...)
+	var out bytes.Buffer
+	if buffer {
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+	} else {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	res.Err = cmd.Run()
+	res.Output = out.Bytes()
+	return
+}
+
+// ExecAll runs the command in argv for each package in sel, a package
+// is only started once all its deps. in sel are done.  Up to jobs
+// commands are run at once.  Unless keepGoing is set no new commands
+// are started once one fails, otherwise only the packages that depend
+// on one that failed are not run.  The packages not run are returned
+// in skipped.
+func ExecAll(sel TodoList, argv []string, jobs int, keepGoing bool) (passed, failed, skipped TodoList) {
+	inSel := map[string]bool{}
+	for _, todo := range sel {
+		inSel[todo.Key()] = true
+	}
+	done := map[string]bool{}
+	hasFailed := map[string]bool{}
+	waiting := append(TodoList{}, sel...)
+	// the indirect deps. are included so that a failure is also
+	// noticed when the packages in between are not in sel
+	failedDep := func(todo *Todo) bool {
+		for _, deps := range [][]string{todo.Deps, todo.AlsoUpdate, todo.Indirect} {
+			for _, dep := range deps {
+				if hasFailed[dep] {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	canStart := func(todo *Todo) bool {
+		for _, dep := range append(append([]string{}, todo.Deps...), todo.AlsoUpdate...) {
+			if inSel[dep] && !done[dep] {
+				return false
+			}
+		}
+		return true
+	}
+	results := make(chan ExecResult)
+	running := 0
+	stop := false
+	for {
+		for !stop && running < jobs {
+			i := 0
+			for i < len(waiting) && !canStart(waiting[i]) {
+				i++
+			}
+			if i == len(waiting) {
+				break
+			}
+			todo := waiting[i]
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			dir, _ := todo.LocalDir()
+			running++
+			if jobs == 1 {
+				fmt.Fprintf(os.Stderr, "==> %s (%s)\n", todo.Key(), dir)
+			}
+			go func() {
+				results <- ExecCmd(todo, argv, jobs > 1)
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		res := <-results
+		running--
+		done[res.Todo.Key()] = true
+		if jobs > 1 {
+			dir, _ := res.Todo.LocalDir()
+			fmt.Fprintf(os.Stderr, "==> %s (%s)\n", res.Todo.Key(), dir)
+			os.Stdout.Write(res.Output)
+		}
+		if res.Err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %s\n", res.Todo.Key(), res.Err.Error())
+			failed = append(failed, res.Todo)
+			hasFailed[res.Todo.Key()] = true
+			stop = !keepGoing
+			stillWaiting := TodoList{}
+			for _, todo := range waiting {
+				if !failedDep(todo) {
+					stillWaiting = append(stillWaiting, todo)
+				}
+			}
+			waiting = stillWaiting
+		} else {
+			passed = append(passed, res.Todo)
+		}
+	}
+	for _, todo := range sel {
+		if !done[todo.Key()] {
+			skipped = append(skipped, todo)
+		}
+	}
+	return
+}
+
+func keys(lst TodoList) []string {
+	res := make([]string, 0, len(lst))
+	for _, todo := range lst {
+		res = append(res, todo.Key())
+	}
+	return res
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestExecAll(t *testing.T) {
+	tests := []struct {
+		fail      string
+		keepGoing bool
+		passed    []string
+		failed    []string
+		skipped   []string
+	}{
+		{"none", false, []string{"A", "B", "C", "root"}, nil, nil},
+		{"C", true, nil, []string{"C"}, []string{"A", "B", "root"}},
+		{"A", true, []string{"B", "C"}, []string{"A"}, []string{"root"}},
+		{"root", true, []string{"A", "B", "C"}, []string{"root"}, nil},
+	}
+	for _, test := range tests {
+		_, lst, err := Gather(testSource(diamond), "C")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, todo := range lst {
+			todo.Dir = t.TempDir()
+		}
+		// the last arguments have no '${' so are passed as is
+		argv := []string{"sh", "-c", `test ${name} != ` + test.fail + ` && test "\$0" = "\[x|y\]" && test "\$1" = '\$HOME'`, "[x|y]", "$HOME"}
+		passed, failed, skipped := ExecAll(lst, argv, 2, test.keepGoing)
+		for _, res := range []struct {
+			what     string
+			got      TodoList
+			expected []string
+		}{{"passed", passed, test.passed}, {"failed", failed, test.failed}, {"skipped", skipped, test.skipped}} {
+			got := keys(res.got)
+			sort.Strings(got)
+			if len(got) == 0 && len(res.expected) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(got, res.expected) {
+				t.Errorf("fail %s: %s: got %v, expected %v", test.fail, res.what, got, res.expected)
+			}
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	_, lst, err := Gather(testSource(diamond), "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName, err := lst.CreateMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]bool{}
+	for _, kv := range byName["A"].Env() {
+		env[kv] = true
+	}
+	for _, kv := range []string{"GXU_NAME=A", "GXU_PATH=example.com/A", "GXU_LEVEL=1", "GXU_DEPS=C"} {
+		if !env[kv] {
+			t.Errorf("%s not in %v", kv, byName["A"].Env())
+		}
+	}
+}
+
+// giturl is undefined for a path without a host, as can be the case
+// for the root module, so is left out
+func TestEnvUndefined(t *testing.T) {
+	todo := &Todo{Name: "myroot", Path: "myroot", backend: ModBackend}
+	env := map[string]bool{}
+	for _, kv := range todo.Env() {
+		env[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	if !env["GXU_PATH"] || env["GXU_GITURL"] || env["GXU_DIR"] || env["GXU_VER"] {
+		t.Errorf("got %v", todo.Env())
+	}
+}
@@ -4,13 +4,149 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"unicode"
 )
 
 var BadFormatStr = fmt.Errorf("bad format string")
 
+// BadFilter is returned for an unknown filter or a filter with a bad
+// argument
+type BadFilter struct {
+	Filter string
+	Msg    string
+}
+
+func (e BadFilter) Error() string {
+	return fmt.Sprintf("bad format string: %s: %s", e.Filter, e.Msg)
+}
+
+// IsBadFormat returns true if err is due to a bad format string, as
+// opposed to a problem with the values
+func IsBadFormat(err error) bool {
+	_, ok := err.(BadFilter)
+	return ok || err == BadFormatStr
+}
+
+type Filter struct {
+	Name string
+	Arg  string // the argument, if any, as shown in the help
+	Desc string
+	// Apply applies the filter to val, it is not called for the
+	// default filter
+	Apply func(val string, arg string) string
+	// Check checks the argument
+	Check func(arg string) error
+}
+
+var Filters = []Filter{
+	{Name: "short", Arg: "n", Desc: "only the first <n> characters, defaults to 8",
+		Apply: func(val string, arg string) string {
+			n := 8
+			if arg != "" {
+				n, _ = strconv.Atoi(arg)
+			}
+			if len(val) > n {
+				return val[:n]
+			}
+			return val
+		},
+		Check: func(arg string) error {
+			if n, err := strconv.Atoi(arg); arg != "" && (err != nil || n < 0) {
+				return fmt.Errorf("expected a number, got: %s", arg)
+			}
+			return nil
+		}},
+	{Name: "upper", Desc: "in upper case",
+		Apply: func(val string, arg string) string { return strings.ToUpper(val) }},
+	{Name: "lower", Desc: "in lower case",
+		Apply: func(val string, arg string) string { return strings.ToLower(val) }},
+	{Name: "join", Arg: "sep", Desc: "join the words of a list, such as $deps, with <sep>",
+		Apply: func(val string, arg string) string { return strings.Join(strings.Fields(val), arg) },
+		Check: func(arg string) error {
+			if arg == "" {
+				return fmt.Errorf("missing separator")
+			}
+			return nil
+		}},
+	{Name: "basename", Desc: "the last element of a path",
+		Apply: func(val string, arg string) string { return filepath.Base(val) }},
+	{Name: "dirname", Desc: "all but the last element of a path",
+		Apply: func(val string, arg string) string { return filepath.Dir(val) }},
+	{Name: "default", Arg: "val", Desc: "<val> if the variable is not defined"},
+}
+
+func FiltersHelp() string {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	for _, f := range Filters {
+		name := f.Name
+		if f.Arg != "" {
+			name += ":<" + f.Arg + ">"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", name, f.Desc)
+	}
+	tw.Flush()
+	return buf.String()
+}
+
+// parseFilters splits '<var>|<filter>[:<arg>]|...' into the variable
+// and the filters to apply
+func parseFilters(key string) (string, []*Filter, []string, error) {
+	parts := strings.Split(key, "|")
+	filters := []*Filter{}
+	filterArgs := []string{}
+	for _, part := range parts[1:] {
+		name, arg := part, ""
+		if i := strings.IndexByte(part, ':'); i != -1 {
+			name, arg = part[:i], part[i+1:]
+		}
+		var filter *Filter
+		for i := range Filters {
+			if Filters[i].Name == name {
+				filter = &Filters[i]
+			}
+		}
+		if filter == nil {
+			return "", nil, nil, BadFilter{name, "unknown filter"}
+		}
+		if filter.Arg == "" && arg != "" {
+			return "", nil, nil, BadFilter{name, "does not take an argument"}
+		}
+		if filter.Check != nil {
+			if err := filter.Check(arg); err != nil {
+				return "", nil, nil, BadFilter{name, err.Error()}
+			}
+		}
+		filters = append(filters, filter)
+		filterArgs = append(filterArgs, arg)
+	}
+	return parts[0], filters, filterArgs, nil
+}
+
+// getFiltered gets the value of key, with any filters applied
+func getFiltered(v Getter, key string) (val string, have bool, err error) {
+	key, filters, filterArgs, err := parseFilters(key)
+	if err != nil {
+		return
+	}
+	val, have, err = v.Get(key)
+	for i, filter := range filters {
+		switch {
+		case filter.Name == "default":
+			if err != nil || !have {
+				val, have, err = filterArgs[i], true, nil
+			}
+		case err == nil && have:
+			val = filter.Apply(val, filterArgs[i])
+		}
+	}
+	return
+}
+
 func FormatHelp(keys []KeyDesc) string {
 	return `
 <fmtstr> syntax:
@@ -21,14 +157,96 @@ func FormatHelp(keys []KeyDesc) string {
   [...]:    Only displays the text if all variables used inside are defined.
             For example to only display the '::' if there are unmet deps. use:
                $path[ :: $unmet]
-  \...:     Standard backslash escaping.
-
+  [...|...]: Displays the text after the '|' instead if not all variables
+            used before it are defined.  For example:
+               $path [= $hash|(not published)]
+            More than one '|' can be used, the first alternative with all
+            variables defined is displayed.  Brackets can be nested.
+  \...:     Standard backslash escaping, use '\|', '\[' and '\]' for a
+            literal '|', '[' and ']'.
+  ${<var>|<filter>[:<arg>]|...}:
+            The value with the filters applied in order.  For example:
+               ${hash|short:8} ${deps|join:, } ${pr|default:none}
+` + eachHelp(keys) + `
+filters:
+` + FiltersHelp() + `
 preset variables:
 ` + KeysHelp(keys)
 }
 
+func eachHelp(keys []KeyDesc) string {
+	lists := []string{}
+	for _, kd := range keys {
+		if kd.List {
+			lists = append(lists, kd.Name)
+		}
+	}
+	if len(lists) == 0 {
+		return ""
+	}
+	var eachKeys bytes.Buffer
+	for _, kd := range EachKeys {
+		lists = append(lists, kd.Name)
+		fmt.Fprintf(&eachKeys, "            '%s' is %s\n", kd.Name, kd.Desc)
+	}
+	return `  ${each <list>:<fmtstr>}:
+            Formats each entry of <list> using <fmtstr>, in which the
+            variables are those of the entry.  <list> is one of:
+               ` + strings.Join(lists, " ") + `
+` + eachKeys.String() + `            A '{' or '}' that is not part of a variable must be escaped.
+            For example:
+               ${each deps:- \[ \] $pr\n}
+`
+}
+
+// Getter provides the values of the variables used in a format string
+type Getter interface {
+	Get(key string) (val string, have bool, err error)
+}
+
+// Lister is implemented by a Getter that has lists of other entries
+// that can be used with ${each ...}
+type Lister interface {
+	List(key string) ([]Getter, bool)
+}
+
+// formatChecker is a Getter with every variable defined and one entry
+// in each of the lists of v, so that all of a format string is used
+type formatChecker struct {
+	v Getter
+}
+
+func (c formatChecker) Get(key string) (string, bool, error) {
+	return "", true, nil
+}
+
+func (c formatChecker) List(key string) ([]Getter, bool) {
+	lister, ok := c.v.(Lister)
+	if !ok {
+		return nil, false
+	}
+	if _, ok := lister.List(key); !ok {
+		return nil, false
+	}
+	return []Getter{c}, true
+}
+
+// CheckFormat checks the whole of fmtstr for errors that do not
+// depend on the values, such as an unknown filter, including the parts
+// that may not be used when formatting, such as the inside of an
+// ${each ...} over an empty list.  v is only used for the names of the
+// lists.
+func CheckFormat(v Getter, fmtstr string) error {
+	_, err := Format(formatChecker{v}, fmtstr)
+	return err
+}
+
 func (v *Todo) Format(fmtorig string) ([]byte, error) {
-	buf, fmt, err := v.format(fmtorig)
+	return Format(v, fmtorig)
+}
+
+func Format(v Getter, fmtorig string) ([]byte, error) {
+	buf, fmt, err := format(v, fmtorig, false)
 	if err != nil && err != defaultUsed {
 		return nil, err
 	}
@@ -40,7 +258,10 @@ func (v *Todo) Format(fmtorig string) ([]byte, error) {
 
 var defaultUsed = errors.New("default used")
 
-func (v *Todo) format(orig string) (buf bytes.Buffer, str string, err error) {
+// format formats orig until the end of the string or a closing ']'.
+// If nested is true it is inside a '[' and also stops at a '|'.  The
+// ']' or '|' is not consumed.
+func format(v Getter, orig string, nested bool) (buf bytes.Buffer, str string, err error) {
 	str = orig
 	for len(str) > 0 {
 		switch str[0] {
@@ -58,18 +279,23 @@ func (v *Todo) format(orig string) (buf bytes.Buffer, str string, err error) {
 				buf.WriteRune(ch)
 			}
 		case '[':
-			b, s, e := v.format(str[1:])
-			if e == BadFormatStr {
+			b, s, ok, e := formatAlt(v, str[1:])
+			if e != nil {
 				err = e
 				return
 			}
-			if e == nil {
+			if ok {
 				buf.Write(b.Bytes())
 			}
 			str = s
 		case ']':
-			str = str[1:]
 			return
+		case '|':
+			if nested {
+				return
+			}
+			buf.WriteByte('|')
+			str = str[1:]
 		case '$':
 			key := ""
 			str = str[1:]
@@ -77,6 +303,31 @@ func (v *Todo) format(orig string) (buf bytes.Buffer, str string, err error) {
 				buf.WriteByte('$')
 				return
 			}
+			if strings.HasPrefix(str, "{each ") {
+				i := matchBrace(str)
+				if i == -1 {
+					err = BadFormatStr
+					return
+				}
+				val, ok, e := formatEach(v, str[len("{each "):i])
+				str = str[i+1:]
+				if IsBadFormat(e) {
+					err = e
+					return
+				}
+				if e != nil {
+					err = e
+					continue
+				}
+				if !ok {
+					if err == nil {
+						err = defaultUsed
+					}
+					continue
+				}
+				buf.Write(val)
+				continue
+			}
 			if str[0] == '{' {
 				i := strings.IndexByte(str, '}')
 				if i == -1 {
@@ -100,7 +351,11 @@ func (v *Todo) format(orig string) (buf bytes.Buffer, str string, err error) {
 				buf.WriteByte('$')
 				continue
 			}
-			val, ok, e := v.Get(key)
+			val, ok, e := getFiltered(v, key)
+			if IsBadFormat(e) {
+				err = e
+				return
+			}
 			if e != nil {
 				err = e
 				continue
@@ -120,6 +375,81 @@ func (v *Todo) format(orig string) (buf bytes.Buffer, str string, err error) {
 	return
 }
 
+// formatAlt formats the alternatives inside a '[', str is just after
+// the '['.  The first alternative with all variables defined is used,
+// if none are ok is false.
+func formatAlt(v Getter, str string) (buf bytes.Buffer, rest string, ok bool, err error) {
+	buf, rest, e := format(v, str, true)
+	if IsBadFormat(e) {
+		return buf, rest, false, e
+	}
+	ok = e == nil
+	switch {
+	case strings.HasPrefix(rest, "|"):
+		// always formatted so the rest of the string is consumed
+		altBuf, altRest, altOk, e := formatAlt(v, rest[1:])
+		if e != nil {
+			return buf, altRest, false, e
+		}
+		if !ok {
+			buf, ok = altBuf, altOk
+		}
+		rest = altRest
+	case strings.HasPrefix(rest, "]"):
+		rest = rest[1:]
+	default:
+		return buf, rest, false, BadFormatStr // missing ']'
+	}
+	return buf, rest, ok, nil
+}
+
+// matchBrace returns the index of the '}' matching the '{' at the
+// start of str, or -1 if there is none
+func matchBrace(str string) int {
+	depth := 0
+	for i := 0; i < len(str); i++ {
+		switch str[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// formatEach formats each entry of a list, spec is '<list>:<fmtstr>'.
+// The result is undefined if the list is empty.
+func formatEach(v Getter, spec string) ([]byte, bool, error) {
+	i := strings.IndexByte(spec, ':')
+	if i == -1 {
+		return nil, false, BadFilter{"each", "missing ':'"}
+	}
+	name, sub := strings.TrimSpace(spec[:i]), spec[i+1:]
+	lister, ok := v.(Lister)
+	if !ok {
+		return nil, false, BadFilter{"each", "no lists available"}
+	}
+	entries, ok := lister.List(name)
+	if !ok {
+		return nil, false, BadFilter{"each", "unknown list: " + name}
+	}
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		b, err := Format(entry, sub)
+		if err != nil {
+			return nil, false, err
+		}
+		buf.Write(b)
+	}
+	return buf.Bytes(), len(entries) > 0, nil
+}
+
 func asciiIsSymbol(ch byte) bool {
 	return '!' <= ch && ch <= '/' || ':' <= ch && ch <= '@' || '[' <= ch && ch <= '`' || '{' <= ch && ch <= '~'
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testVars is a Getter for testing, an empty value is defined but
+// has no value, like $deps when there are no deps.
+type testVars map[string]string
+
+func (v testVars) Get(key string) (string, bool, error) {
+	val, ok := v[key]
+	if !ok {
+		return "", false, fmt.Errorf("'%s' undefined", key)
+	}
+	return val, val != "", nil
+}
+
+type formatTest struct {
+	fmt string
+	res string
+	err bool
+}
+
+func testFormat(t *testing.T, v Getter, tests []formatTest) {
+	t.Helper()
+	for _, test := range tests {
+		res, err := Format(v, test.fmt)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%q: expected error, got %q", test.fmt, res)
+		case !test.err && err != nil:
+			t.Errorf("%q: unexpected error: %s", test.fmt, err)
+		case !test.err && string(res) != test.res:
+			t.Errorf("%q: got %q, expected %q", test.fmt, res, test.res)
+		}
+	}
+}
+
+func TestFormatAlt(t *testing.T) {
+	v := testVars{"a": "A", "b": "B", "empty": ""}
+	testFormat(t, v, []formatTest{
+		{"$a", "A", false},
+		{"${a}x", "Ax", false},
+		{"$nosuch", "", true},
+		{"$a[ $b]", "A B", false},
+		{"$a[ $nosuch]", "A", false},
+		{"$a[ $empty]", "A", false},
+		{"$a [= $b|(none)]", "A = B", false},
+		{"$a [= $nosuch|(none)]", "A (none)", false},
+		{"[$nosuch|$empty|$b|$a]", "B", false},
+		{"[$nosuch|$empty]", "", false},
+		{"[$nosuch|]", "", false},
+		{"[$a|$nosuch]", "A", false},
+		// nested
+		{"[$a [$b|nob]|noa]", "A B", false},
+		{"[$a [$nosuch|nob]|noa]", "A nob", false},
+		{"[$nosuch [$b|nob]|noa]", "noa", false},
+		{"[[$nosuch|$empty]|x]", "", false},
+		{"[x[$nosuch]y|z]", "xy", false},
+		// escaped
+		{`\[$a\]`, "[A]", false},
+		{`[$a\|$b|c]`, "A|B", false},
+		{`[$nosuch\|$b|c]`, "c", false},
+		{`$a\n`, "A\n", false},
+		{"a|b", "a|b", false},
+		// unbalanced
+		{"$a]", "", true},
+		{"[$a]]", "", true},
+		{"[$a", "", true},
+		{"[$a|[$b]", "", true},
+	})
+}
+
+func TestMatchBrace(t *testing.T) {
+	tests := []struct {
+		str string
+		i   int
+	}{
+		{"{}", 1},
+		{"{abc}def", 4},
+		{"{a{b}c}d}", 6},
+		{`{a\}b}`, 5},
+		{`{a\{b}`, 5},
+		{"{a{b}", -1},
+		{"{", -1},
+		{`{a\}`, -1},
+	}
+	for _, test := range tests {
+		if i := matchBrace(test.str); i != test.i {
+			t.Errorf("matchBrace(%q) = %d, expected %d", test.str, i, test.i)
+		}
+	}
+}
+
+// testLister is a testVars with lists of other entries
+type testLister struct {
+	testVars
+	lists map[string][]Getter
+}
+
+func (v testLister) List(key string) ([]Getter, bool) {
+	lst, ok := v.lists[key]
+	return lst, ok
+}
+
+func TestFormatEach(t *testing.T) {
+	v := testLister{
+		testVars{"name": "root"},
+		map[string][]Getter{
+			"deps": {
+				testVars{"name": "A", "pr": "pr/1"},
+				testVars{"name": "B"},
+			},
+			"none": {},
+		},
+	}
+	testFormat(t, v, []formatTest{
+		{"${each deps:$name }", "A B ", false},
+		{"$name:${each deps: $name[=$pr]}", "root: A=pr/1 B", false},
+		{"${each deps:${pr|default:none}\n}", "pr/1\nnone\n", false},
+		{`${each deps:\{$name\}}`, "{A}{B}", false},
+		{"${each deps:[$name]}", "AB", false},
+		{"${each deps:$pr}", "", true},
+		// an empty list is undefined
+		{"[${each none:$name}|empty]", "empty", false},
+		{"[x${each deps:$name}|empty]", "xAB", false},
+		{"${each none:$name}", "", false},
+		// bad format strings
+		{"${each nosuch:$name}", "", true},
+		{"${each deps}", "", true},
+		{"${each deps:$name", "", true},
+		{"${each deps:{$name}", "", true},
+		{"${each deps:$name]}", "", true},
+	})
+	// lists require a Lister
+	testFormat(t, testVars{}, []formatTest{
+		{"${each deps:$name}", "", true},
+	})
+}
+
+func TestReservedKeys(t *testing.T) {
+	for _, key := range []string{"name", "hash", "unmetdeps"} {
+		if CheckInternal(key) == nil {
+			t.Errorf("%s: expected to be reserved", key)
+		}
+	}
+	for _, kd := range EachKeys {
+		if err := CheckInternal(kd.Name); err != nil {
+			t.Errorf("%s: %s", kd.Name, err)
+		}
+	}
+}
+
+func TestCheckFormat(t *testing.T) {
+	tests := []struct {
+		fmt string
+		ok  bool
+	}{
+		{"$name [$nosuch|${x|short:4}]", true},
+		{"${each deps:${pr|default:none}}", true},
+		{"${name|bogus}", false},
+		{"[$name|${x|bogus}]", false},
+		{"[$name|[$x|${x|short:x}]]", false},
+		{"${each deps:${pr|bogus}}", false},
+		{"${each deps:${each deps:${pr|upper:x}}}", false},
+		{"${each nosuch:$name}", false},
+		{"[$name", false},
+	}
+	for _, test := range tests {
+		err := CheckFormat(&Todo{}, test.fmt)
+		if test.ok && err != nil {
+			t.Errorf("%q: unexpected error: %s", test.fmt, err)
+		}
+		if !test.ok && !IsBadFormat(err) {
+			t.Errorf("%q: expected bad format error, got %v", test.fmt, err)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The go modules backend uses "<module path>@<version>" in place of
+// the gx hash, which conveniently is also what 'go get' expects.
+
+const (
+	GxBackend  = "gx"
+	ModBackend = "mod"
+)
+
+// DetectBackend returns the backend to use for the package in dir.  A
+// package.json takes precedence over a go.mod.
+func DetectBackend(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "package.json")); err == nil {
+		return GxBackend, nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+		return ModBackend, nil
+	}
+	return "", fmt.Errorf("neither package.json nor go.mod found")
+}
+
+type ModFile struct {
+	Module  string
+	Require []ModRequire
+	Replace map[string]ModReplace
+}
+
+type ModRequire struct {
+	Path     string
+	Version  string
+	Indirect bool
+}
+
+// ModReplace is the target of a replace directive.  If Version is
+// empty Path is a local directory.
+type ModReplace struct {
+	Path    string
+	Version string
+}
+
+func ModHash(path, version string) Hash {
+	return Hash(path + "@" + version)
+}
+
+func SplitModHash(hash Hash) (path string, version string) {
+	str := string(hash)
+	i := strings.LastIndexByte(str, '@')
+	if i == -1 {
+		return str, ""
+	}
+	return str[:i], str[i+1:]
+}
+
+func ModCacheDir() string {
+	dir := os.Getenv("GOMODCACHE")
+	if dir != "" {
+		return dir
+	}
+	return filepath.Join(strings.Split(GOPATH, string(filepath.ListSeparator))[0], "pkg", "mod")
+}
+
+// escapeModPath escapes upper case letters the same way the go
+// command does for paths in the module cache
+func escapeModPath(path string) string {
+	var buf bytes.Buffer
+	for _, ch := range path {
+		if unicode.IsUpper(ch) {
+			buf.WriteByte('!')
+			buf.WriteRune(unicode.ToLower(ch))
+		} else {
+			buf.WriteRune(ch)
+		}
+	}
+	return buf.String()
+}
+
+func ModCacheFile(modCache, path, version string) string {
+	return filepath.Join(modCache, "cache", "download", escapeModPath(path), "@v", escapeModPath(version)+".mod")
+}
+
+func ReadModFile(fn string) (*ModFile, error) {
+	bytes, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := ParseModFile(string(bytes))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err.Error())
+	}
+	return mod, nil
+}
+
+func ParseModFile(str string) (*ModFile, error) {
+	mod := &ModFile{Replace: map[string]ModReplace{}}
+	block := ""
+	for lineNo, line := range strings.Split(str, "\n") {
+		indirect := false
+		if i := strings.Index(line, "//"); i != -1 {
+			indirect = strings.TrimSpace(line[i+2:]) == "indirect"
+			line = line[:i]
+		}
+		fields, err := modFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo+1, err.Error())
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if block == "" {
+			if len(fields) == 2 && fields[1] == "(" {
+				block = fields[0]
+				continue
+			}
+		} else if len(fields) == 1 && fields[0] == ")" {
+			block = ""
+			continue
+		} else {
+			fields = append([]string{block}, fields...)
+		}
+		switch fields[0] {
+		case "module":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: bad module directive", lineNo+1)
+			}
+			mod.Module = fields[1]
+		case "require":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("line %d: bad require directive", lineNo+1)
+			}
+			mod.Require = append(mod.Require, ModRequire{fields[1], fields[2], indirect})
+		case "replace":
+			// replace <path> [<version>] => <path> [<version>]
+			i := 0
+			for i = range fields {
+				if fields[i] == "=>" {
+					break
+				}
+			}
+			if i < 2 || i > 3 || len(fields)-i < 2 || len(fields)-i > 3 {
+				return nil, fmt.Errorf("line %d: bad replace directive", lineNo+1)
+			}
+			repl := ModReplace{Path: fields[i+1]}
+			if len(fields)-i == 3 {
+				repl.Version = fields[i+2]
+			}
+			mod.Replace[fields[1]] = repl
+		}
+	}
+	if mod.Module == "" {
+		return nil, fmt.Errorf("no module directive")
+	}
+	return mod, nil
+}
+
+func modFields(line string) ([]string, error) {
+	fields := []string{}
+	line = strings.TrimSpace(line)
+	for len(line) > 0 {
+		var field string
+		if line[0] == '"' || line[0] == '`' {
+			i := strings.IndexByte(line[1:], line[0])
+			if i == -1 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			var err error
+			field, err = strconv.Unquote(line[:i+2])
+			if err != nil {
+				return nil, err
+			}
+			line = line[i+2:]
+		} else {
+			i := strings.IndexFunc(line, unicode.IsSpace)
+			if i == -1 {
+				i = len(line)
+			}
+			field = line[:i]
+			line = line[i:]
+		}
+		fields = append(fields, field)
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+	}
+	return fields, nil
+}
+
+// ModSource is a PackageSource for go modules.  The version of each
+// module is selected from the module graph using minimal version
+// selection and the go.mod of the selected version is then used to
+// determine its deps.  Deps marked as indirect are ignored.  Only
+// replace directives in the root go.mod are honored, as is done by
+// the go command.
+type ModSource struct {
+	Root     string // directory of the root module
+	ModCache string
+
+	mu       sync.Mutex
+	root     *ModFile
+	modFiles map[Hash]*ModFile
+	selected map[string]string
+}
+
+func NewModSource(root string) *ModSource {
+	return &ModSource{Root: root, ModCache: ModCacheDir()}
+}
+
+func (src *ModSource) readMod(path, version string) (*ModFile, error) {
+	hash := ModHash(path, version)
+	if mod, ok := src.modFiles[hash]; ok {
+		return mod, nil
+	}
+	fn := ModCacheFile(src.ModCache, path, version)
+	if repl, ok := src.root.Replace[path]; ok {
+		if repl.Version == "" {
+			fn = filepath.Join(modDir(src.Root, repl.Path), "go.mod")
+		} else {
+			fn = ModCacheFile(src.ModCache, repl.Path, repl.Version)
+		}
+	}
+	mod, err := ReadModFile(fn)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("go.mod for %s@%s not found, try running 'go mod download'", path, version)
+	} else if err != nil {
+		return nil, err
+	}
+	src.modFiles[hash] = mod
+	return mod, nil
+}
+
+// load reads the root go.mod and selects the versions to use
+func (src *ModSource) load() error {
+	if src.root != nil {
+		return nil
+	}
+	root, err := filepath.Abs(src.Root)
+	if err != nil {
+		return err
+	}
+	src.Root = root
+	src.root, err = ReadModFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return err
+	}
+	src.modFiles = map[Hash]*ModFile{}
+	src.selected = map[string]string{}
+	todo := []string{}
+	for _, req := range src.root.Require {
+		if CompareVersions(req.Version, src.selected[req.Path]) > 0 {
+			src.selected[req.Path] = req.Version
+			todo = append(todo, req.Path)
+		}
+	}
+	for len(todo) > 0 {
+		path := todo[0]
+		todo = todo[1:]
+		mod, err := src.readMod(path, src.selected[path])
+		if err != nil {
+			src.root = nil
+			return err
+		}
+		for _, req := range mod.Require {
+			if req.Path == src.root.Module {
+				continue
+			}
+			if CompareVersions(req.Version, src.selected[req.Path]) > 0 {
+				src.selected[req.Path] = req.Version
+				todo = append(todo, req.Path)
+			}
+		}
+	}
+	return nil
+}
+
+func (src *ModSource) Package(hash Hash, name string) (*PackageFile, error) {
+	// may be called from more than one goroutine
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	err := src.load()
+	if err != nil {
+		return nil, err
+	}
+	mod := src.root
+	dir := src.Root
+	version := ""
+	if hash != "" {
+		var path string
+		path, version = SplitModHash(hash)
+		mod, err = src.readMod(path, version)
+		if err != nil {
+			return nil, err
+		}
+		dir = ""
+		if repl, ok := src.root.Replace[path]; ok && repl.Version == "" {
+			dir = modDir(src.Root, repl.Path)
+		}
+	}
+	pkg := &PackageFile{Name: name, Version: version, Dir: dir}
+	if hash == "" {
+		pkg.Name = mod.Module
+	}
+	pkg.Gx.Dvcsimport = pkg.Name
+	for _, req := range mod.Require {
+		if req.Indirect || req.Path == src.root.Module {
+			continue
+		}
+		pkg.GxDependencies = append(pkg.GxDependencies, PackageDep{
+			Hash: ModHash(req.Path, src.selected[req.Path]),
+			Name: req.Path,
+		})
+	}
+	return pkg, nil
+}
+
+// ReadPackage returns the information in the go.mod in dir using the
+// same types as for gx, with the module path used as the name and
+// "<module path>@<version>" as the hash.
+func (src *ModSource) ReadPackage(dir string) (*PackageFile, error) {
+	mod, err := ReadModFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	pkg := &PackageFile{Name: mod.Module}
+	pkg.Gx.Dvcsimport = mod.Module
+	for _, req := range mod.Require {
+		pkg.GxDependencies = append(pkg.GxDependencies, PackageDep{
+			Hash: ModHash(req.Path, req.Version),
+			Name: req.Path,
+		})
+	}
+	return pkg, nil
+}
+
+// ReadLastPubVer uses the highest version tag pointing to HEAD as the
+// last published version, NoVersionTag is returned if there is none.
+func (src *ModSource) ReadLastPubVer(dir string) (*LastPubVer, error) {
+	mod, err := ReadModFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	version, err := ReadGitTag(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &LastPubVer{
+		Version: version,
+		Hash:    ModHash(mod.Module, version),
+	}, nil
+}
+
+func modDir(rootDir string, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(rootDir, path)
+}
+
+// CompareVersions compares two semantic versions returning -1, 0 or
+// 1.  The empty string is less than any other version.
+func CompareVersions(x, y string) int {
+	if x == y {
+		return 0
+	}
+	if y == "" {
+		return 1
+	}
+	if x == "" {
+		return -1
+	}
+	xmain, xpre := splitVersion(x)
+	ymain, ypre := splitVersion(y)
+	for i := 0; i < 3; i++ {
+		if c := compareNum(xmain[i], ymain[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case xpre == "" && ypre == "":
+		return 0
+	case xpre == "":
+		return 1
+	case ypre == "":
+		return -1
+	}
+	xids := strings.Split(xpre, ".")
+	yids := strings.Split(ypre, ".")
+	for i := 0; i < len(xids) && i < len(yids); i++ {
+		xnum := isNum(xids[i])
+		ynum := isNum(yids[i])
+		c := 0
+		switch {
+		case xnum && ynum:
+			c = compareNum(xids[i], yids[i])
+		case xnum:
+			c = -1
+		case ynum:
+			c = 1
+		default:
+			c = strings.Compare(xids[i], yids[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(xids) < len(yids):
+		return -1
+	case len(xids) > len(yids):
+		return 1
+	}
+	return 0
+}
+
+func splitVersion(v string) (main [3]string, pre string) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexByte(v, '+'); i != -1 {
+		v = v[:i]
+	}
+	if i := strings.IndexByte(v, '-'); i != -1 {
+		pre = v[i+1:]
+		v = v[:i]
+	}
+	main = [3]string{"0", "0", "0"}
+	copy(main[:], strings.SplitN(v, ".", 3))
+	return
+}
+
+func isNum(str string) bool {
+	if str == "" {
+		return false
+	}
+	for _, ch := range str {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func compareNum(x, y string) int {
+	x = strings.TrimLeft(x, "0")
+	y = strings.TrimLeft(y, "0")
+	if len(x) != len(y) {
+		if len(x) < len(y) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(x, y)
+}
+
+// NoVersionTag is returned by ReadGitTag when HEAD was never
+// published
+var NoVersionTag = fmt.Errorf("no version tag points to HEAD")
+
+// ReadGitTag returns the highest version tag that points to HEAD of
+// the git repository in dir, or NoVersionTag if there is none
+func ReadGitTag(dir string) (string, error) {
+	cmd := exec.Command("git", "tag", "--points-at", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git tag: %s", err.Error())
+	}
+	version := ""
+	for _, tag := range strings.Fields(string(out)) {
+		if len(tag) < 2 || tag[0] != 'v' || !isNum(tag[1:2]) {
+			continue
+		}
+		if CompareVersions(tag, version) > 0 {
+			version = tag
+		}
+	}
+	if version == "" {
+		return "", NoVersionTag
+	}
+	return version, nil
+}
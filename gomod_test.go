@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseModFile(t *testing.T) {
+	str := `module example.com/root
+
+go 1.12
+
+require example.com/a v1.0.0
+require (
+	example.com/b v1.2.3 // indirect
+	"example.com/c" v0.0.0-20190101000000-0123456789ab
+	example.com/d v2.0.0+incompatible // a comment
+)
+
+replace example.com/a => ../a
+replace (
+	example.com/b v1.2.3 => example.com/b2 v1.2.4
+	example.com/c => /abs/c
+)
+`
+	mod, err := ParseModFile(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ModFile{
+		Module: "example.com/root",
+		Require: []ModRequire{
+			{"example.com/a", "v1.0.0", false},
+			{"example.com/b", "v1.2.3", true},
+			{"example.com/c", "v0.0.0-20190101000000-0123456789ab", false},
+			{"example.com/d", "v2.0.0+incompatible", false},
+		},
+		Replace: map[string]ModReplace{
+			"example.com/a": {"../a", ""},
+			"example.com/b": {"example.com/b2", "v1.2.4"},
+			"example.com/c": {"/abs/c", ""},
+		},
+	}
+	if !reflect.DeepEqual(mod, expected) {
+		t.Errorf("got %+v, expected %+v", mod, expected)
+	}
+}
+
+func TestParseModFileErrors(t *testing.T) {
+	tests := []string{
+		"require example.com/a v1.0.0\n",
+		"module\n",
+		"module example.com/root\nrequire example.com/a\n",
+		"module example.com/root\nreplace example.com/a\n",
+		"module example.com/root\nreplace => ../a\n",
+		"module \"example.com/root\n",
+	}
+	for _, str := range tests {
+		if _, err := ParseModFile(str); err == nil {
+			t.Errorf("expected error for %q", str)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		x, y string
+		c    int
+	}{
+		{"", "", 0},
+		{"", "v0.0.0", -1},
+		{"v1.0.0", "v1.0.0", 0},
+		{"v1.0.0", "v1.0.1", -1},
+		{"v1.10.0", "v1.9.0", 1},
+		{"v2.0.0", "v10.0.0", -1},
+		{"v1.0.0-alpha", "v1.0.0", -1},
+		{"v1.0.0-alpha", "v1.0.0-alpha.1", -1},
+		{"v1.0.0-alpha.1", "v1.0.0-alpha.beta", -1},
+		{"v1.0.0-beta.2", "v1.0.0-beta.11", -1},
+		{"v1.0.0-rc.1", "v1.0.0-beta.11", 1},
+		// pseudo-versions
+		{"v0.0.0-20190101000000-0123456789ab", "v0.0.0-20200101000000-0123456789ab", -1},
+		{"v0.0.0-20190101000000-0123456789ab", "v0.1.0", -1},
+		{"v1.2.4-0.20190101000000-0123456789ab", "v1.2.3", 1},
+		{"v1.2.4-0.20190101000000-0123456789ab", "v1.2.4", -1},
+		// build metadata is ignored
+		{"v2.0.0+incompatible", "v2.0.0", 0},
+		{"v2.0.1+incompatible", "v2.0.0+incompatible", 1},
+	}
+	for _, test := range tests {
+		if c := CompareVersions(test.x, test.y); c != test.c {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected %d", test.x, test.y, c, test.c)
+		}
+		if c := CompareVersions(test.y, test.x); c != -test.c {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected %d", test.y, test.x, c, -test.c)
+		}
+	}
+}
+
+func TestSelectModVersion(t *testing.T) {
+	pkgs := Packages{}
+	for _, hash := range []Hash{"example.com/a@v1.2.3", "example.com/a@v1.10.0", "example.com/b@v0.1.0"} {
+		path, _ := SplitModHash(hash)
+		pkgs[hash] = &PkgInfo{Hash: hash, Name: path}
+	}
+	tests := []struct {
+		sel  string
+		hash Hash // empty if an error is expected
+	}{
+		{"example.com/b", "example.com/b@v0.1.0"},
+		{"example.com/a@v1.2.3", "example.com/a@v1.2.3"},
+		{"example.com/a@v1.2", "example.com/a@v1.2.3"},
+		{"example.com/a@v1.10", "example.com/a@v1.10.0"},
+		{"example.com/a@example.com/a@v1.10.0", "example.com/a@v1.10.0"},
+		{"example.com/a@v1.1", ""},
+		{"example.com/a@v1", ""},
+		{"example.com/a@v2", ""},
+		{"example.com/a", ""},
+	}
+	for _, test := range tests {
+		found, err := pkgs.Select(test.sel)
+		switch {
+		case test.hash == "" && err == nil:
+			t.Errorf("%s: expected error, got %v", test.sel, found)
+		case test.hash != "" && err != nil:
+			t.Errorf("%s: %s", test.sel, err)
+		case test.hash != "" && (len(found) != 1 || found[0].Hash != test.hash):
+			t.Errorf("%s: got %v, expected %s", test.sel, found, test.hash)
+		}
+	}
+	byName := TodoByName{}
+	for hash, pkg := range pkgs {
+		todo := &Todo{Name: pkg.Name, OrigHash: hash, Id: pkg.Name + "@" + string(hash)}
+		byName[todo.Key()] = todo
+	}
+	for _, test := range tests {
+		todo, err := byName.Find(test.sel)
+		switch {
+		case test.hash == "" && err == nil:
+			t.Errorf("find %s: expected error, got %s", test.sel, todo.Key())
+		case test.hash != "" && err != nil:
+			t.Errorf("find %s: %s", test.sel, err)
+		case test.hash != "" && todo.OrigHash != test.hash:
+			t.Errorf("find %s: got %s, expected %s", test.sel, todo.OrigHash, test.hash)
+		}
+	}
+}
+
+// A module path without a '/', such as 'module myroot', is valid so
+// $giturl is undefined rather than an error in the format string
+func TestModRootWithoutHost(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"go.mod":   "module myroot\n\nrequire example.com/a v1.0.0\n\nreplace example.com/a => ./a\n",
+		"a/go.mod": "module example.com/a\n",
+	}
+	for fn, contents := range files {
+		fn = filepath.Join(root, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := NewModSource(root)
+	src.ModCache = t.TempDir()
+	_, lst, err := Gather(src, "example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"example.com/a": "git@example.com:a.git", "myroot": "none"}
+	got := map[string]string{}
+	for _, todo := range lst {
+		todo.backend = ModBackend
+		str, err := todo.Format("[$giturl|none]")
+		if err != nil {
+			t.Fatalf("%s: %s", todo.Name, err)
+		}
+		got[todo.Name] = string(str)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+	if _, err := lst[len(lst)-1].Format("$giturl"); err == nil || IsBadFormat(err) {
+		t.Errorf("expected $giturl to be undefined for myroot, got %v", err)
+	}
+}
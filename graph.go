@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// State returns one of published, invalidated, ready or blocked
+func (v *Todo) State() string {
+	switch {
+	case v.Published:
+		return "published"
+	case len(v.NewDeps) > 0:
+		return "invalidated"
+	case v.Ready:
+		return "ready"
+	default:
+		return "blocked"
+	}
+}
+
+var graphColors = map[string]string{
+	"published":   "#a6e3a1",
+	"invalidated": "#f38ba8",
+	"ready":       "#f9e2af",
+	"blocked":     "#d9d9d9",
+}
+
+type graphEdge struct {
+	from, to string
+	also     bool
+}
+
+// graphLayout collects what is needed to draw the reverse dep. graph,
+// the edges go from a dep. to the packages that depend on it
+func graphLayout(lst TodoList, byName TodoByName, fmtstr string) (ids map[*Todo]string, labels map[*Todo]string, levels [][]*Todo, edges []graphEdge, err error) {
+	ids = map[*Todo]string{}
+	labels = map[*Todo]string{}
+	for i, todo := range lst {
+		ids[todo] = fmt.Sprintf("n%d", i)
+		var label []byte
+		label, err = todo.Format(fmtstr)
+		if err != nil {
+			return
+		}
+		labels[todo] = string(label)
+		for len(levels) <= todo.Level {
+			levels = append(levels, nil)
+		}
+		levels[todo.Level] = append(levels[todo.Level], todo)
+	}
+	for _, todo := range lst {
+		for _, dep := range todo.Deps {
+			edges = append(edges, graphEdge{ids[byName[dep]], ids[todo], false})
+		}
+		for _, dep := range todo.AlsoUpdate {
+			edges = append(edges, graphEdge{ids[byName[dep]], ids[todo], true})
+		}
+	}
+	return
+}
+
+func GraphDot(lst TodoList, byName TodoByName, fmtstr string) ([]byte, error) {
+	ids, labels, levels, edges, err := graphLayout(lst, byName, fmtstr)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("digraph gx_update {\n")
+	buf.WriteString("  node [shape=box, style=filled];\n")
+	for level, todos := range levels {
+		fmt.Fprintf(&buf, "  subgraph level%d {\n", level)
+		buf.WriteString("    rank=same;\n")
+		for _, todo := range todos {
+			fmt.Fprintf(&buf, "    %s [label=%s, fillcolor=%s];\n",
+				ids[todo], dotQuote(labels[todo]), dotQuote(graphColors[todo.State()]))
+		}
+		buf.WriteString("  }\n")
+	}
+	for _, e := range edges {
+		if e.also {
+			fmt.Fprintf(&buf, "  %s -> %s [style=dashed];\n", e.from, e.to)
+		} else {
+			fmt.Fprintf(&buf, "  %s -> %s;\n", e.from, e.to)
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+func GraphMermaid(lst TodoList, byName TodoByName, fmtstr string) ([]byte, error) {
+	ids, labels, levels, edges, err := graphLayout(lst, byName, fmtstr)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("flowchart TB\n")
+	for level, todos := range levels {
+		fmt.Fprintf(&buf, "  subgraph level%d [Level %d]\n", level, level)
+		for _, todo := range todos {
+			fmt.Fprintf(&buf, "    %s[\"%s\"]:::%s\n", ids[todo], mermaidEscape(labels[todo]), todo.State())
+		}
+		buf.WriteString("  end\n")
+	}
+	for _, e := range edges {
+		if e.also {
+			fmt.Fprintf(&buf, "  %s -.-> %s\n", e.from, e.to)
+		} else {
+			fmt.Fprintf(&buf, "  %s --> %s\n", e.from, e.to)
+		}
+	}
+	for _, state := range []string{"published", "invalidated", "ready", "blocked"} {
+		fmt.Fprintf(&buf, "  classDef %s fill:%s\n", state, graphColors[state])
+	}
+	return buf.Bytes(), nil
+}
+
+func dotQuote(str string) string {
+	str = strings.Replace(str, `\`, `\\`, -1)
+	str = strings.Replace(str, `"`, `\"`, -1)
+	str = strings.Replace(str, "\n", `\n`, -1)
+	return `"` + str + `"`
+}
+
+func mermaidEscape(str string) string {
+	str = strings.Replace(str, `"`, "#quot;", -1)
+	str = strings.Replace(str, "\n", "<br>", -1)
+	return str
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestGraph(t *testing.T) {
+	weird := `we"ird\pkg`
+	_, lst, err := Gather(testSource(map[string][]string{
+		"root": {"A", "B", "C"},
+		"A":    {"C", weird},
+		"B":    {"C"},
+		"C":    {},
+		weird:  {},
+	}), "C", weird)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName, err := lst.CreateMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName["C"].NewHash, byName["C"].NewVersion = "QmC2", "1.0.1"
+	// published against an older C so invalidated
+	byName["A"].NewHash, byName["A"].NewDeps = "QmA2", map[string]Hash{"C": "QmC1"}
+	UpdateState(lst, byName)
+	for _, test := range []struct {
+		golden string
+		graph  func(TodoList, TodoByName, string) ([]byte, error)
+	}{
+		{"graph.dot", GraphDot},
+		{"graph.mmd", GraphMermaid},
+	} {
+		out, err := test.graph(lst, byName, `$name[\n$ver]`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := filepath.Join("testdata", test.golden)
+		if *updateGolden {
+			if err := ioutil.WriteFile(fn, out, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, expected) {
+			t.Errorf("%s: got:\n%s\nexpected:\n%s", test.golden, out, expected)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The history log is an append-only log of every change to the state
+// stored next to the state file with one JSON encoded entry per line.
+
+type LogEntry struct {
+	Time    time.Time
+	Event   string
+	Package string `json:",omitempty"` // id of the package
+	Key     string `json:",omitempty"` // meta-data key
+	Old     string `json:",omitempty"`
+	New     string `json:",omitempty"`
+	User    string `json:",omitempty"`
+}
+
+var LogEvents = []string{"published", "reset", "clean", "invalidated", "meta", "refresh", "undo", "redo"}
+
+var LogKeys = []KeyDesc{
+	{Name: "time", Desc: "time of the event"},
+	{Name: "event", Desc: "one of: " + strings.Join(LogEvents, " ")},
+	{Name: "name", Desc: "package the event applies to, undefined for defaults", Alias: "pkg"},
+	{Name: "key", Desc: "the meta-data key for meta events"},
+	{Name: "old", Desc: "the old value, if any"},
+	{Name: "new", Desc: "the new value, if any"},
+	{Name: "user", Desc: "the git user that caused the event"},
+}
+
+func (e *LogEntry) Get(key string) (val string, have bool, err error) {
+	switch key {
+	case "time":
+		val = e.Time.Format(time.RFC3339)
+	case "event":
+		val = e.Event
+	case "name", "pkg":
+		val = e.Package
+	case "key":
+		val = e.Key
+	case "old":
+		val = e.Old
+	case "new":
+		val = e.New
+	case "user":
+		val = e.User
+	default:
+		err = fmt.Errorf("'%s' undefined", key)
+		return
+	}
+	have = val != ""
+	return
+}
+
+func logFile(fn string) string {
+	return fn + ".log"
+}
+
+var gitUser string
+
+// GitUser returns the user as configured in git, falling back to
+// $USER
+func GitUser() string {
+	if gitUser != "" {
+		return gitUser
+	}
+	name, _ := exec.Command("git", "config", "user.name").Output()
+	email, _ := exec.Command("git", "config", "user.email").Output()
+	gitUser = strings.TrimSpace(string(name))
+	if e := strings.TrimSpace(string(email)); e != "" {
+		gitUser = strings.TrimSpace(fmt.Sprintf("%s <%s>", gitUser, e))
+	}
+	if gitUser == "" {
+		gitUser = os.Getenv("USER")
+	}
+	return gitUser
+}
+
+// AppendLog appends entries to the history log of the state file fn
+func AppendLog(fn string, entries ...LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(logFile(fn), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	now := time.Now()
+	user := GitUser()
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		entry.Time = now
+		entry.User = user
+		bytes, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		w.Write(bytes)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func ReadLog(fn string) ([]LogEntry, error) {
+	f, err := os.Open(logFile(fn))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []LogEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry LogEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %s", logFile(fn), lineNo, err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Matches returns true if the entry is for one of events, or any event
+// if events is empty, and for the package pkgName, which is either an
+// id or a name matching all versions of the package, or any package if
+// pkgName is empty.
+func (e *LogEntry) Matches(events NameSet, pkgName string) bool {
+	if len(events) > 0 && !events.Has(e.Event) {
+		return false
+	}
+	return pkgName == "" || e.Package == pkgName || strings.SplitN(e.Package, "@", 2)[0] == pkgName
+}
+
+// PubInfo returns the published info of v in the form logged
+func (v *Todo) PubInfo() string {
+	if v.NewHash == "" {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s", v.NewHash, v.NewVersion))
+}
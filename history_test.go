@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), ".gx-update-state.json")
+	gitUser = "tester"
+	defer func() { gitUser = "" }()
+
+	entries, err := ReadLog(fn)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("empty log: got %v %v", entries, err)
+	}
+	if err := AppendLog(fn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(logFile(fn)); !os.IsNotExist(err) {
+		t.Errorf("log created with no entries")
+	}
+
+	first := []LogEntry{
+		{Event: "published", Package: "A", New: "QmA2 1.0.1"},
+		{Event: "invalidated", Package: "B@QmB1"},
+	}
+	second := []LogEntry{
+		{Event: "meta", Package: "B@QmB2", Key: "pr", New: "12"},
+		{Event: "meta", Key: "pr", Old: "1", New: "none"},
+		{Event: "reset", Package: "A", Old: "QmA2 1.0.1"},
+	}
+	for _, lst := range [][]LogEntry{first, second} {
+		if err := AppendLog(fn, lst...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err = ReadLog(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append([]LogEntry{}, first...), second...)
+	if len(entries) != len(expected) {
+		t.Fatalf("got %d entries, expected %d", len(entries), len(expected))
+	}
+	for i, entry := range entries {
+		if entry.Time.IsZero() || entry.User != "tester" {
+			t.Errorf("%d: time or user not set: %+v", i, entry)
+		}
+		entry.Time, entry.User = expected[i].Time, ""
+		if !reflect.DeepEqual(entry, expected[i]) {
+			t.Errorf("%d: got %+v, expected %+v", i, entry, expected[i])
+		}
+	}
+	// one entry per line
+	data, err := ioutil.ReadFile(logFile(fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); len(lines) != len(expected) {
+		t.Errorf("got %d lines, expected %d", len(lines), len(expected))
+	}
+
+	filters := []struct {
+		events []string
+		pkg    string
+		res    []int
+	}{
+		{nil, "", []int{0, 1, 2, 3, 4}},
+		{nil, "A", []int{0, 4}},
+		{nil, "B", []int{1, 2}},
+		{nil, "B@QmB2", []int{2}},
+		{nil, "C", []int{}},
+		{[]string{"meta"}, "", []int{2, 3}},
+		{[]string{"meta", "reset"}, "", []int{2, 3, 4}},
+		{[]string{"meta"}, "B", []int{2}},
+		{[]string{"undo"}, "", []int{}},
+	}
+	for _, f := range filters {
+		events := NameSet{}
+		events.Add(f.events...)
+		res := []int{}
+		for i, entry := range entries {
+			if entry.Matches(events, f.pkg) {
+				res = append(res, i)
+			}
+		}
+		if !reflect.DeepEqual(res, f.res) {
+			t.Errorf("%v %q: got %v, expected %v", f.events, f.pkg, res, f.res)
+		}
+	}
+
+	// a corrupted line is reported
+	if err := ioutil.WriteFile(logFile(fn), append(data, "{bad\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadLog(fn); err == nil || !strings.Contains(err.Error(), "line 6") {
+		t.Errorf("expected an error for line 6, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Maximum number of changes that can be undone
+var journalSize = 20
+
+// Journal keeps the previous versions of the state file so that
+// changes can be undone and redone.  It is stored next to the state
+// file.
+type Journal struct {
+	Undo []JournalEntry `json:",omitempty"`
+	Redo []JournalEntry `json:",omitempty"`
+}
+
+type JournalEntry struct {
+	Desc  string          // description of the change
+	State json.RawMessage // the state file from before the change
+}
+
+func journalFile(fn string) string {
+	return fn + ".journal"
+}
+
+func ReadJournal(fn string) (*Journal, error) {
+	journal := &Journal{}
+	data, err := ioutil.ReadFile(journalFile(fn))
+	if os.IsNotExist(err) {
+		return journal, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, journal)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", journalFile(fn), err.Error())
+	}
+	return journal, nil
+}
+
+func (journal *Journal) Write(fn string) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(journalFile(fn), data, 0644, true)
+}
+
+// RecordChange records that the state file fn was changed from prev.
+// Any changes that can be redone are discarded.
+func RecordChange(fn string, desc string, prev []byte) error {
+	journal, err := ReadJournal(fn)
+	if err != nil {
+		return err
+	}
+	journal.Undo = append(journal.Undo, JournalEntry{desc, json.RawMessage(prev)})
+	if len(journal.Undo) > journalSize {
+		journal.Undo = journal.Undo[len(journal.Undo)-journalSize:]
+	}
+	journal.Redo = nil
+	return journal.Write(fn)
+}
+
+// Undo restores the state file fn to the state from before the last
+// change, if redo is true the last undone change is reapplied
+// instead.  The description of the change is returned.
+func Undo(fn string, redo bool) (string, error) {
+	err := LockState(fn)
+	if err != nil {
+		return "", err
+	}
+	journal, err := ReadJournal(fn)
+	if err != nil {
+		return "", err
+	}
+	from, to := &journal.Undo, &journal.Redo
+	if redo {
+		from, to = to, from
+	}
+	if len(*from) == 0 {
+		if redo {
+			return "", fmt.Errorf("nothing to redo")
+		}
+		return "", fmt.Errorf("nothing to undo")
+	}
+	entry := (*from)[len(*from)-1]
+	*from = (*from)[:len(*from)-1]
+	cur, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return "", err
+	}
+	*to = append(*to, JournalEntry{entry.Desc, json.RawMessage(cur)})
+	var buf bytes.Buffer
+	err = json.Indent(&buf, entry.State, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	buf.WriteByte('\n')
+	err = WriteFileAtomic(fn, buf.Bytes(), fi.Mode().Perm(), true)
+	if err != nil {
+		return "", err
+	}
+	return entry.Desc, journal.Write(fn)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUndo(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), ".gx-update-state.json")
+	t.Setenv("GX_UPDATE_STATE", fn)
+	_, lst, err := Gather(testSource(diamond), "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteStateFile(fn, JsonState{Version: StateVersion, Todo: lst}, 0644, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer UnlockState()
+
+	// the empty journal
+	for _, redo := range []bool{false, true} {
+		if _, err := Undo(fn, redo); err == nil {
+			t.Errorf("redo %v: expected error for an empty journal", redo)
+		}
+	}
+
+	// newHash returns the hash C is marked with in the state file
+	newHash := func() Hash {
+		t.Helper()
+		lst, byName, err := GetTodo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		UpdateState(lst, byName)
+		if byName["C"].Published != (byName["C"].NewHash != "") {
+			t.Errorf("C: published is %v with hash %q", byName["C"].Published, byName["C"].NewHash)
+		}
+		return byName["C"].NewHash
+	}
+	mark := func(hash Hash, desc string) {
+		t.Helper()
+		lst, byName, err := GetTodoLocked()
+		if err != nil {
+			t.Fatal(err)
+		}
+		byName["C"].NewHash = hash
+		UpdateState(lst, byName)
+		if err := lst.Write(desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	undo := func(redo bool, expected string) {
+		t.Helper()
+		desc, err := Undo(fn, redo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc != expected {
+			t.Errorf("got %q, expected %q", desc, expected)
+		}
+	}
+
+	mark("QmC2", "published C")
+	mark("", "published reset C")
+	if hash := newHash(); hash != "" {
+		t.Errorf("reset: C marked as %s", hash)
+	}
+
+	undo(false, "published reset C")
+	if hash := newHash(); hash != "QmC2" {
+		t.Errorf("undo reset: C marked as %q, expected QmC2", hash)
+	}
+	undo(false, "published C")
+	if hash := newHash(); hash != "" {
+		t.Errorf("undo publish: C marked as %s", hash)
+	}
+	if _, err := Undo(fn, false); err == nil {
+		t.Errorf("expected nothing left to undo")
+	}
+
+	undo(true, "published C")
+	if hash := newHash(); hash != "QmC2" {
+		t.Errorf("redo: C marked as %q, expected QmC2", hash)
+	}
+
+	// a new change discards what can be redone
+	mark("QmC3", "published C again")
+	if _, err := Undo(fn, true); err == nil {
+		t.Errorf("expected nothing to redo after a new change")
+	}
+	undo(false, "published C again")
+	if hash := newHash(); hash != "QmC2" {
+		t.Errorf("undo after redo: C marked as %q, expected QmC2", hash)
+	}
+}
+
+// A meta change that changes nothing is not journaled or logged so
+// that undo reverts the last real change
+func TestMetaUnchanged(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), ".gx-update-state.json")
+	t.Setenv("GX_UPDATE_STATE", fn)
+	_, lst, err := Gather(testSource(diamond), "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteStateFile(fn, JsonState{Version: StateVersion, Todo: lst}, 0644, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer UnlockState()
+	for _, argv := range [][]string{
+		{"-p", "C", "set", "pr", "1"},
+		{"-p", "C", "set", "pr", "1"},
+		{"-p", "C", "unset", "nosuch"},
+		{"default", "unset", "nosuch"},
+	} {
+		if err := metaCmd.Exec(argv); err != nil {
+			t.Fatalf("%v: %s", argv, err)
+		}
+	}
+	entries, err := ReadLog(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d log entries, expected 1: %+v", len(entries), entries)
+	}
+	desc, err := Undo(fn, false)
+	if err != nil || desc != "meta set pr 1 (C)" {
+		t.Errorf("got %q (%v), expected the first set to be undone", desc, err)
+	}
+	if _, err := Undo(fn, false); err == nil {
+		t.Errorf("expected nothing left to undo")
+	}
+}
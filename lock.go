@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for another invocation to release the lock on the
+// state file before giving up
+var lockTimeout = 10 * time.Second
+
+var stateLock *os.File
+
+// LockState acquires an advisory lock on the state file fn so that
+// concurrent invocations don't interleave their read-modify-write
+// cycles.  The lock is held until UnlockState is called or the
+// process exits.  The lock is on a separate file as the state file
+// itself is replaced on every write.
+func LockState(fn string) error {
+	if stateLock != nil {
+		return nil
+	}
+	f, err := os.OpenFile(fn+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		ok, err := tryLockFile(f.Fd())
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			bytes, _ := ioutil.ReadFile(fn + ".lock")
+			pid, err := strconv.Atoi(strings.TrimSpace(string(bytes)))
+			if err != nil {
+				return fmt.Errorf("session is locked by another process")
+			}
+			return fmt.Errorf("session is locked by pid %d", pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	stateLock = f
+	return nil
+}
+
+func UnlockState() {
+	if stateLock == nil {
+		return
+	}
+	stateLock.Truncate(0)
+	unlockFile(stateLock.Fd())
+	stateLock.Close()
+	stateLock = nil
+}
@@ -0,0 +1,15 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+// Advisory locks are only supported on the platforms with flock, on
+// others, such as windows, the state file is still written atomically.
+
+func tryLockFile(fd uintptr) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(fd uintptr) error {
+	return nil
+}
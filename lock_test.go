@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+const lockWrites = 5
+
+// TestLockHelper is run in a separate process by TestLockConcurrentWrites
+// as the lock is per process
+func TestLockHelper(t *testing.T) {
+	id := os.Getenv("GXU_TEST_LOCK_ID")
+	if id == "" {
+		t.Skip("only run by TestLockConcurrentWrites")
+	}
+	for i := 0; i < lockWrites; i++ {
+		lst, byName, err := GetTodoLocked()
+		if err != nil {
+			t.Fatal(err)
+		}
+		todo := byName["C"]
+		if todo.Meta == nil {
+			todo.Meta = map[string]string{}
+		}
+		key := fmt.Sprintf("w%s-%d", id, i)
+		todo.Meta[key] = "x"
+		if err := lst.Write("meta set " + key); err != nil {
+			t.Fatal(err)
+		}
+		UnlockState()
+	}
+}
+
+func TestLockConcurrentWrites(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	fn := filepath.Join(t.TempDir(), ".gx-update-state.json")
+	t.Setenv("GX_UPDATE_STATE", fn)
+	_, lst, err := Gather(testSource(diamond), "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteStateFile(fn, JsonState{Version: StateVersion, Todo: lst}, 0644, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const procs = 6
+	cmds := []*exec.Cmd{}
+	for i := 0; i < procs; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+		cmd.Env = append(os.Environ(), "GXU_TEST_LOCK_ID="+strconv.Itoa(i))
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("helper failed: %s", err)
+		}
+	}
+	_, byName, err := GetTodo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := byName["C"].Meta
+	for i := 0; i < procs; i++ {
+		for j := 0; j < lockWrites; j++ {
+			key := fmt.Sprintf("w%d-%d", i, j)
+			if meta[key] != "x" {
+				t.Errorf("write %s lost", key)
+			}
+		}
+	}
+	if len(meta) != procs*lockWrites {
+		t.Errorf("got %d keys, expected %d", len(meta), procs*lockWrites)
+	}
+}
+
+// Only the commands that change the state wait for the lock
+func TestLockReadOnly(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), ".gx-update-state.json")
+	t.Setenv("GX_UPDATE_STATE", fn)
+	_, lst, err := Gather(testSource(diamond), "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteStateFile(fn, JsonState{Version: StateVersion, Todo: lst}, 0644, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flock locks are per open file so this conflicts with LockState
+	// even though it is in the same process
+	f, err := os.OpenFile(fn+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if ok, err := tryLockFile(f.Fd()); !ok || err != nil {
+		t.Fatalf("could not lock: %v", err)
+	}
+	defer unlockFile(f.Fd())
+	prevTimeout := lockTimeout
+	lockTimeout = 0
+	defer func() { lockTimeout = prevTimeout }()
+	defer UnlockState()
+	if _, _, err := GetTodo(); err != nil {
+		t.Errorf("read only: %s", err)
+	}
+	if err := metaCmd.Exec([]string{"-p", "C", "vals"}); err != nil {
+		t.Errorf("meta vals: %s", err)
+	}
+	if _, _, err := GetTodoLocked(); err == nil {
+		t.Errorf("expected an error while the state is locked")
+	}
+	if err := metaCmd.Exec([]string{"-p", "C", "set", "pr", "1"}); err == nil {
+		t.Errorf("meta set: expected an error while the state is locked")
+	}
+}
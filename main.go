@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"go/build"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var GOPATH string
@@ -16,7 +21,12 @@ var GXROOT string
 func InitGlobal() error {
 	GOPATH = os.Getenv("GOPATH")
 	if GOPATH == "" {
-		return fmt.Errorf("GOPATH not set")
+		// as done by the go tool, needed for go modules where
+		// GOPATH is normally not set
+		GOPATH = build.Default.GOPATH
+	}
+	if GOPATH == "" {
+		return fmt.Errorf("GOPATH not set and no home directory to default to")
 	}
 	GXROOT = filepath.Join(GOPATH, "src/gx/ipfs")
 	return nil
@@ -38,7 +48,9 @@ func RootPath(path string) (string, error) {
 	return rootPath, nil
 }
 
-var args = os.Args[1:]
+// the remaining arguments to the current command once the options
+// have been parsed
+var args []string
 var curCmd *Command
 
 func Shift() (string, bool) {
@@ -53,27 +65,73 @@ func Shift() (string, bool) {
 type Command struct {
 	Name    string
 	Tagline string
-	Usage   string
+	Opts    []*Opt
+	Args    string // arguments as shown in the usage
 	Help    string
 	Run     func() error
+	Hidden  bool // not listed in the help or completed
 }
 
 var reqGxUpdateState = "\nRequires the GX_UPDATE_STATE env. variable to be set.  See init sub-command."
 
 func UsageErr() error {
-	return fmt.Errorf("%s %s\n", os.Args[0], curCmd.Usage)
+	return curCmd.UsageErr()
+}
+
+// Common options
+func fmtOpt(help string) *Opt {
+	return &Opt{Short: "f", Long: "format", Type: StringOpt, Arg: "fmtstr", Help: help}
+}
+
+func pkgOpt(help string) *Opt {
+	return &Opt{Short: "p", Long: "pkg", Type: StringOpt, Arg: "pkg", Help: help}
+}
+
+func backendOpts() []*Opt {
+	return []*Opt{
+		{Long: "gx", Help: "use gx packages"},
+		{Long: "mod", Help: "use go modules"},
+	}
+}
+
+// backend returns the backend selected by the --gx and --mod options,
+// if neither is given the backend is detected from the current
+// directory
+func backend() (string, error) {
+	switch {
+	case curCmd.Flag("gx"):
+		return GxBackend, nil
+	case curCmd.Flag("mod"):
+		return ModBackend, nil
+	}
+	return DetectBackend(".")
 }
 
 var cmds = []*Command{
 	&previewCmd,
 	&initCmd,
+	&refreshCmd,
 	&statusCmd,
 	&stateCmd,
 	&listCmd,
 	&depsCmd,
 	&publishedCmd,
+	&updateDepsCmd,
+	&verifyCmd,
+	&watchCmd,
 	&toPinCmd,
 	&metaCmd,
+	&undoCmd,
+	&redoCmd,
+	&logCmd,
+	&graphCmd,
+	&whyCmd,
+	&nextCmd,
+	&execCmd,
+	&cacheCmd,
+	&shellInitCmd,
+	&completionCmd,
+	&completeCmd,
 }
 
 func mainFun() error {
@@ -81,57 +139,80 @@ func mainFun() error {
 	if err != nil {
 		return err
 	}
-	cmd := ""
-	rest := []string{}
+	argv := os.Args[1:]
 	showHelp := false
-	for len(args) != 0 {
-		arg, _ := Shift()
-		switch {
-		case arg == "-h" || arg == "--help":
-			showHelp = true
-		case len(arg) > 0 && arg[0] == '-':
-			rest = append(rest, arg)
-		case cmd == "":
-			cmd = arg
-		default:
-			rest = append(rest, arg)
-		}
+	if len(argv) > 0 && (argv[0] == "-h" || argv[0] == "--help") {
+		showHelp = true
+		argv = argv[1:]
 	}
-	args = rest
-	usageErr := fmt.Errorf("Usage: %s [-h] preview|init|status|list|deps|published|to-pin|meta", os.Args[0])
-	if !showHelp && cmd == "" {
-		return usageErr
+	names := []string{}
+	for _, c := range visibleCmds() {
+		names = append(names, c.Name)
 	}
-	if showHelp && cmd == "" {
+	usageErr := fmt.Errorf("Usage: %s [-h] %s", os.Args[0], strings.Join(names, "|"))
+	if len(argv) == 0 {
+		if !showHelp {
+			return usageErr
+		}
 		fmt.Printf("%s\n\n", usageErr.Error())
-		for _, c := range cmds {
-			fmt.Printf("  %-10s %s\n", c.Name, c.Tagline)
+		width := 0
+		for _, c := range visibleCmds() {
+			if len(c.Name) > width {
+				width = len(c.Name)
+			}
+		}
+		for _, c := range visibleCmds() {
+			fmt.Printf("  %-*s %s\n", width, c.Name, c.Tagline)
 		}
 		fmt.Printf("\n")
 		return nil
 	}
-	for _, c := range cmds {
-		if c.Name == cmd {
-			curCmd = c
-			break
-		}
-	}
+	cmd := argv[0]
+	argv = argv[1:]
+	curCmd = cmdByName(cmd)
 	if curCmd == nil {
 		return fmt.Errorf("unknown command: %s", cmd)
 	}
 	if showHelp {
-		fmt.Printf("Usage: %s %s\n", os.Args[0], curCmd.Usage)
-		fmt.Printf("%s\n", curCmd.Help)
-		return nil
-	} else {
-		return curCmd.Run()
+		argv = []string{"--help"}
+	}
+	defer UnlockState()
+	return curCmd.Exec(argv)
+}
+
+// parseCond parses a condition given as '[not] [<cond>]'
+func parseCond(argv []string) (cond string, invert bool, ok bool) {
+	if len(argv) > 0 && argv[0] == "not" {
+		if len(argv) == 1 {
+			return "", false, false
+		}
+		invert = true
+		argv = argv[1:]
+	}
+	if len(argv) > 0 {
+		cond = argv[0]
+		argv = argv[1:]
+	}
+	return cond, invert, len(argv) == 0
+}
+
+func cmdByName(name string) *Command {
+	for _, c := range cmds {
+		if c.Name == name {
+			return c
+		}
 	}
+	return nil
 }
 
 var previewCmd = Command{
 	Name:    "preview",
 	Tagline: "Show dep. that need to be changed to change <dep> in current package",
-	Usage:   "preview [--json|--list] [-f <fmtstr>] <dep>",
+	Opts: append(backendOpts(),
+		&Opt{Long: "json", Help: "output detailed info as JSON"},
+		&Opt{Long: "list", Help: "just list the dependencies"},
+		fmtOpt("format of each dependency")),
+	Args: "<dep>...",
 	Help: `
 Show decencies that need to be changed in order to change <dep> in the
 current package.  The normal output lists each decency and what that
@@ -139,6 +220,21 @@ decency directly depends on.  If --json is given a more detailed
 output is given is using JSON.  If --list is given just the decencies
 are listed.
 
+More than one <dep> can be given in which case the decencies for
+all of them are merged into a single list.  Use '$targets' to see
+which <dep> caused a decency to be included.
+
+If there is more than one version of <dep> all of them are listed.
+Use <dep>@<hash> to select one of them, where <hash> can be a prefix,
+or <dep>@all to select all of them.  The entries for such packages
+are then identified by '<dep>@<hash>' in the output, see '$id'.
+
+Both gx packages and go modules are supported.  The --gx or --mod
+option selects which one to use, otherwise gx is used if there is a
+package.json in the current directory and go modules if there is a
+go.mod.  When using go modules <dep> is the module path and the hash
+is the module path and version seperated by an '@'.
+
 The -f option can be used to customize the output.  It defaults to
 '$path[ :: $deps]' for the normal output and '$path' if the --list
 option is given.
@@ -147,37 +243,38 @@ option is given.
 }
 
 func previewCmdRun() error {
-	var err error
-	if len(os.Args) <= 2 {
+	names := args
+	if len(names) == 0 {
 		return UsageErr()
 	}
 	mode := ""
-	name := ""
-	fmtstr := ""
-	for len(args) > 0 {
-		arg, _ := Shift()
-		switch arg {
-		case "--json":
-			mode = "json"
-		case "--list":
-			mode = "list"
-		case "-f":
-			arg, ok := Shift()
-			if !ok {
-				UsageErr()
-			}
-			fmtstr = arg
-		default:
-			if arg == "" || arg[0] == '-' {
-				return UsageErr()
-			}
-			name = arg
-		}
+	switch {
+	case curCmd.Flag("json"):
+		mode = "json"
+	case curCmd.Flag("list"):
+		mode = "list"
+	}
+	fmtstr := curCmd.String("format", "")
+	if err := CheckFormat(&Todo{}, fmtstr); err != nil {
+		return err
+	}
+	backend, err := backend()
+	if err != nil {
+		return err
+	}
+	_, todoList, err := Gather(NewSource(backend, "."), names...)
+	if err != nil {
+		return err
 	}
-	_, todoList, err := Gather(name)
+	// needed for ${each ...}
+	byName, err := todoList.CreateMap()
 	if err != nil {
 		return err
 	}
+	for _, todo := range todoList {
+		todo.others = byName
+		todo.backend = backend
+	}
 	switch mode {
 	case "":
 		if fmtstr == "" {
@@ -217,9 +314,11 @@ func previewCmdRun() error {
 var initCmd = Command{
 	Name:    "init",
 	Tagline: "Starts a new session for updating <dep> in the current package",
-	Usage:   "init <name>",
+	Opts:    backendOpts(),
+	Args:    "<dep>...",
 	Help: `
-Starts a new session for updating <dep> in the current package.  It
+Starts a new session for updating <dep> in the current package.  More
+than one <dep> can be given to update several packages at once.  It
 creates a JSON file. '.gx-update-state.json', to keep track of the
 current state in the curent directory.  All command except this one
 and 'preview' expect the location to be set in the GX_UPDATE_STATE
@@ -227,61 +326,142 @@ environmental variable.
 
 The command will output the necessary command to set this variable to
 the correct value for Bourne shells
+
+The --gx and --mod options are the same as for the 'preview' command.
 `,
 	Run: initCmdRun,
 }
 
 func initCmdRun() error {
-	if len(os.Args) != 3 {
-		return fmt.Errorf("usage: %s init <dep>", os.Args[0])
+	names := args
+	if len(names) == 0 {
+		return UsageErr()
 	}
-	pkgs, todoList, err := Gather(os.Args[2])
+	backend, err := backend()
 	if err != nil {
 		return err
 	}
-	// Make sure there are no duplicate entries
-	_, err = todoList.CreateMap()
+	pkgs, todoList, err := Gather(NewSource(backend, "."), names...)
 	if err != nil {
 		return err
 	}
-	rootPath, err := RootPath(pkgs[""].Path)
+	// Make sure there are no duplicate entries
+	byName, err := todoList.CreateMap()
 	if err != nil {
 		return err
 	}
+	UpdateState(todoList, byName)
+	rootPath := pkgs[""].Dir
+	if rootPath == "" {
+		rootPath, err = RootPath(pkgs[""].Path)
+		if err != nil {
+			return err
+		}
+	}
 	path := filepath.Join(rootPath, ".gx-update-state.json")
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	state := JsonState{Version: StateVersion, Todo: todoList}
+	if backend != GxBackend {
+		state.Backend = backend
+	}
+	err = WriteStateFile(path, state, 0644, false)
+	if err != nil {
+		return err
+	}
+	// remove any journal and log left over from a previous session
+	for _, fn := range []string{journalFile(path), logFile(path)} {
+		err = os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	fmt.Printf("export GX_UPDATE_STATE=%s\n", path)
+	return nil
+}
+
+var refreshCmd = Command{
+	Name:    "refresh",
+	Tagline: "Refresh the current session against the current dep. graph",
+	Help: `
+Refresh the current session against the current dependency graph.
+The dependencies of the package the session was started in are
+gathered again and merged into the existing state.  Newly required
+packages are added, packages no longer needed are dropped and the
+level and deps of each package are recomputed.  The published info
+and meta-data of existing packages are kept.
+
+A summary of what changed is printed.
+` + reqGxUpdateState,
+	Run: refreshCmdRun,
+}
+
+func refreshCmdRun() error {
+	if len(args) != 0 {
+		return UsageErr()
+	}
+	oldList, _, err := GetTodoLocked()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	state := JsonState{Todo: todoList}
-	err = Encode(f, state)
+	// The state file lives in the root directory of the package the
+	// session was started in
+	src := NewSource(oldList[0].backend, filepath.Dir(os.Getenv("GX_UPDATE_STATE")))
+	_, todoList, err := Gather(src, oldList.Targets()...)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("export GX_UPDATE_STATE=%s\n", path)
+	byName, err := todoList.CreateMap()
+	if err != nil {
+		return err
+	}
+	summary := todoList.Merge(oldList)
+	for _, todo := range todoList {
+		todo.defaults = oldList[0].defaults
+		todo.backend = oldList[0].backend
+		todo.others = byName
+	}
+	UpdateState(todoList, byName)
+	err = todoList.Write("refresh", LogEntry{
+		Event: "refresh",
+		New:   fmt.Sprintf("%d added, %d removed, %d changed", len(summary.Added), len(summary.Removed), len(summary.Changed)),
+	})
+	if err != nil {
+		return err
+	}
+	if len(summary.Added)+len(summary.Removed)+len(summary.Changed) == 0 {
+		fmt.Printf("no changes\n")
+		return nil
+	}
+	for _, name := range summary.Added {
+		fmt.Printf("added: %s\n", name)
+	}
+	for _, name := range summary.Removed {
+		fmt.Printf("removed: %s\n", name)
+	}
+	for _, name := range summary.Changed {
+		fmt.Printf("changed: %s\n", name)
+	}
 	return nil
 }
 
 var statusCmd = Command{
 	Name:    "status",
 	Tagline: "Show current status.",
-	Usage:   "status",
 	Help: `
 Show current status.
 
 Alias for: list -f '$path[ ($invalidated)][ = $hash][ $ready][ :: $unmet]' --by-level
 ` + reqGxUpdateState,
 	Run: func() error {
-		args = []string{"-f", "$path[ ($invalidated)][ = $hash][ $ready][ :: $unmet]", "--by-level"}
-		return listCmdRun()
+		if len(args) != 0 {
+			return UsageErr()
+		}
+		return listCmd.Exec([]string{"-f", "$path[ ($invalidated)][ = $hash][ $ready][ :: $unmet]", "--by-level"})
 	},
 }
 
 var stateCmd = Command{
 	Name:    "state",
 	Tagline: "Show state as JSON file",
-	Usage:   "state",
 	Help: `
 Show state as JSON file
 ` + reqGxUpdateState,
@@ -302,7 +482,11 @@ Show state as JSON file
 var listCmd = Command{
 	Name:    "list",
 	Tagline: "Lists all dep. optionally matching a condition in useful ways",
-	Usage:   "list [-f <fmtstr>] [--by-level] [not] [ready|published|<user-cond>]",
+	Opts: []*Opt{
+		fmtOpt("format of each entry, defaults to '$path'"),
+		{Long: "by-level", Help: "group the entries by level"},
+	},
+	Args: "[not] [ready|published|<user-cond>]",
 	Help: `
 Lists all the dep. optionally matching a condition in useful ways.
 
@@ -320,36 +504,13 @@ To list all packages that are ready to be updated by directory:
 }
 
 func listCmdRun() error {
-	var ok bool
-	invert := false
-	cond := ""
-	fmtstr := "$path"
-	bylevel := false
-	for len(args) > 0 {
-		arg, _ := Shift()
-		switch arg {
-		case "-f":
-			fmtstr, ok = Shift()
-			if !ok {
-				return UsageErr()
-			}
-		case "not":
-			invert = true
-			cond, ok = Shift()
-			if !ok {
-				return UsageErr()
-			}
-		case "--by-level":
-			bylevel = true
-		default:
-			if len(arg) > 0 && arg[0] == '-' {
-				return UsageErr()
-			}
-			cond = arg
-			break
-		}
+	fmtstr := curCmd.String("format", "$path")
+	if err := CheckFormat(&Todo{}, fmtstr); err != nil {
+		return err
 	}
-	if len(args) != 0 {
+	bylevel := curCmd.Flag("by-level")
+	cond, invert, ok := parseCond(args)
+	if !ok {
 		return UsageErr()
 	}
 	lst, _, err := GetTodo()
@@ -368,7 +529,7 @@ func listCmdRun() error {
 		}
 		if ok {
 			str, err := todo.Format(fmtstr)
-			if err == BadFormatStr {
+			if IsBadFormat(err) {
 				return err
 			} else if err != nil {
 				fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
@@ -391,11 +552,17 @@ func listCmdRun() error {
 var depsCmd = Command{
 	Name:    "deps",
 	Tagline: "List dep. of current package",
-	Usage:   "deps [-f <fmtstr>] [-p <pkg>] [direct] [also] [to-update] [indirect] [all]",
+	Opts: []*Opt{
+		fmtOpt("format of each dependency, defaults to '$path'"),
+		pkgOpt("package to use instead of the current package"),
+	},
+	Args: "[direct] [also] [to-update] [indirect] [all]",
 	Help: `
 List dependencies of current or specified package.  The '-p' option
 specifies the package to use.  If it is omitted the current package is
-used instead.
+used instead.  If there is more than one version of a package use
+<name>@<hash> to select one, where <hash> can be a prefix of the
+original hash.
 
 If no additional arguments are given list the direct dep.  Otherwise
 lists the depences as given by the following arguments:
@@ -411,8 +578,11 @@ If the -f option is omitted, it defaults to '$path'.
 }
 
 func depsCmdRun() error {
-	fmtstr := "$path"
-	pkgName := ""
+	fmtstr := curCmd.String("format", "$path")
+	if err := CheckFormat(&Todo{}, fmtstr); err != nil {
+		return err
+	}
+	pkgName := curCmd.String("pkg", "")
 	which := map[int]string{}
 	for len(args) > 0 {
 		arg, _ := Shift()
@@ -430,18 +600,6 @@ func depsCmdRun() error {
 			which[1] = "direct"
 			which[2] = "also"
 			which[3] = "indirect"
-		case "-f":
-			arg, ok := Shift()
-			if !ok {
-				return UsageErr()
-			}
-			fmtstr = arg
-		case "-p":
-			arg, ok := Shift()
-			if !ok {
-				return UsageErr()
-			}
-			pkgName = arg
 		default:
 			return UsageErr()
 		}
@@ -450,20 +608,20 @@ func depsCmdRun() error {
 		which[1] = "direct"
 	}
 
-	_, byName, err := GetTodo()
+	lst, byName, err := GetTodo()
 	if err != nil {
 		return err
 	}
 	if pkgName == "" {
-		pkg, err := ReadPackage(".")
+		pkg, err := NewSource(lst[0].backend, "").ReadPackage(".")
 		if err != nil {
 			return err
 		}
 		pkgName = pkg.Name
 	}
-	todo, ok := byName[pkgName]
-	if !ok {
-		return fmt.Errorf("could not find entry for %s", pkgName)
+	todo, err := byName.Find(pkgName)
+	if err != nil {
+		return err
 	}
 
 	deps := []string{}
@@ -485,7 +643,7 @@ func depsCmdRun() error {
 	for _, dep := range deps {
 		todo := byName[dep]
 		str, err := todo.Format(fmtstr)
-		if err == BadFormatStr {
+		if IsBadFormat(err) {
 			return err
 		} else if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
@@ -505,12 +663,18 @@ func depsCmdRun() error {
 var publishedCmd = Command{
 	Name:    "published",
 	Tagline: "change the published state of a package",
-	Usage:   "published reset|clean",
+	Opts: []*Opt{
+		pkgOpt("package to mark or reset, as <name>@<hash>"),
+		{Long: "scan", Help: "mark all packages that were published"},
+	},
+	Args: "[reset|clean]",
 	Help: `
 Change the publihsed state of a package.
 
 With no arguments the current package will be mark as potently being
-published with the hash as given in .gx/lastpubver.  It also record
+published with the hash as given in .gx/lastpubver.  When using go
+modules the version is instead taken from the highest version tag
+pointing to HEAD.  It also record
 the hash of the deps as given in package.json.  The package will only
 be marked as published if all those hashes match the recorded
 published hash, otherwise the package will be marked as being in an
@@ -518,74 +682,361 @@ invalidated state.
 
 If the 'reset' argument is given then clear the published into.
 
+If there is more than one version of the current package in the
+session the '-p' option must be used to select the one to mark or
+reset using <name>@<hash>, where <hash> is the original hash or a
+prefix of it.
+
 If the 'clean' option is given remove the published info state of ALL
 packages in an invalidated state.
+
+If the --scan option is given the directory of every package in the
+session is visited instead of using the current package.  The packages
+with a release newer than the version the session was started with,
+that is not already marked, are marked as above.  The root package is
+not visited.  Which packages became published or invalidated is
+printed.
 ` + reqGxUpdateState,
 	Run: publishedCmdRun,
 }
 
 func publishedCmdRun() error {
 	mode := "mark"
-	if len(args) > 0 {
-		mode, _ = Shift()
-	}
-	if len(args) > 0 {
+	pkgName := curCmd.String("pkg", "")
+	switch len(args) {
+	case 0:
+	case 1:
+		if args[0] != "reset" && args[0] != "clean" {
+			return UsageErr()
+		}
+		mode = args[0]
+	default:
 		return UsageErr()
 	}
-	todoList, todoByName, err := GetTodo()
+	if curCmd.Flag("scan") {
+		if mode != "mark" || pkgName != "" {
+			return UsageErr()
+		}
+		mode = "scan"
+	}
+	todoList, todoByName, err := GetTodoLocked()
 	if err != nil {
 		return err
 	}
+	desc := "published clean"
+	events := []LogEntry{}
+	var scanErrs []error
 	switch mode {
 	case "clean":
 		for _, todo := range todoList {
 			if todo.Published {
 				continue
 			}
+			if todo.NewHash != "" {
+				events = append(events, LogEntry{Event: "clean", Package: todo.Key(), Old: todo.PubInfo()})
+			}
 			todo.NewHash = ""
 			todo.NewVersion = ""
 			todo.NewDeps = nil
 		}
+	case "scan":
+		src := NewSource(todoList[0].backend, filepath.Dir(os.Getenv("GX_UPDATE_STATE")))
+		events, scanErrs = todoList.ScanPublished(src)
+		for _, err := range scanErrs {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		}
+		desc = fmt.Sprintf("published --scan (%d marked)", len(events))
 	case "mark", "reset":
-		pkg, lastPubVer, err := GetGxInfo()
+		pkg, lastPubVer, err := GetPubInfo(NewSource(todoList[0].backend, ""), ".")
 		if err != nil {
 			return err
 		}
-		todo, ok := todoByName[pkg.Name]
-		if !ok {
-			return fmt.Errorf("could not find entry for %s", pkg.Name)
+		todo, err := todoByName.FindCurrent(pkg.Name, pkgName)
+		if err != nil {
+			return err
 		}
+		oldInfo := todo.PubInfo()
 		switch mode {
 		case "mark":
-			todo.NewHash = lastPubVer.Hash
-			todo.NewVersion = lastPubVer.Version
-			depMap := map[string]Hash{}
-			for _, dep := range pkg.GxDependencies {
-				if todoByName[dep.Name] != nil {
-					depMap[dep.Name] = dep.Hash
-				}
-			}
-			todo.NewDeps = depMap
+			todo.Mark(pkg, lastPubVer)
+			desc = fmt.Sprintf("published %s (%s %s)", todo.Key(), todo.NewHash, todo.NewVersion)
+			events = append(events, LogEntry{Event: "published", Package: todo.Key(), Old: oldInfo, New: todo.PubInfo()})
 		case "reset":
 			todo.NewHash = ""
 			todo.NewVersion = ""
 			todo.NewDeps = nil
+			desc = fmt.Sprintf("published reset %s", todo.Key())
+			events = append(events, LogEntry{Event: "reset", Package: todo.Key(), Old: oldInfo})
 		}
 	default:
 		return UsageErr()
 	}
-	UpdateState(todoList, todoByName)
-	err = todoList.Write()
+	events = append(events, UpdateStateEvents(todoList, todoByName)...)
+	err = todoList.Write(desc, events...)
+	if err != nil {
+		return err
+	}
+	if mode == "scan" {
+		changed := NameSet{}
+		for _, event := range events {
+			changed.Add(event.Package)
+		}
+		published, invalidated, unchanged := []string{}, []string{}, []string{}
+		for _, todo := range todoList {
+			switch {
+			case !changed.Has(todo.Key()):
+				unchanged = append(unchanged, todo.Key())
+			case todo.Published:
+				published = append(published, fmt.Sprintf("%s (%s %s)", todo.Key(), todo.NewVersion, todo.NewHash))
+			default:
+				invalidated = append(invalidated, todo.Key())
+			}
+		}
+		for _, res := range []struct {
+			what string
+			lst  []string
+		}{{"published", published}, {"invalidated", invalidated}, {"unchanged", unchanged}} {
+			if len(res.lst) > 0 {
+				fmt.Printf("%s: %s\n", res.what, strings.Join(res.lst, " "))
+			}
+		}
+	}
+	if len(scanErrs) > 0 {
+		return fmt.Errorf("%d packages could not be checked", len(scanErrs))
+	}
+	return nil
+}
+
+var updateDepsCmd = Command{
+	Name:    "update-deps",
+	Tagline: "Update the deps. in package.json to the published hashes",
+	Opts: []*Opt{
+		pkgOpt("package to update, as <name>@<hash>"),
+		{Short: "n", Long: "dry-run", Help: "only show what would be changed"},
+		{Long: "force", Help: "update even if it would downgrade a dep."},
+	},
+	Help: `
+Update the gxDependencies in the package.json of the current package
+to the hash and version of each dep. that is published in the session.
+The file is changed in place, everything else in it is kept as is.
+This is faster than running 'gx update' for each dep.
+
+The deps. that are not yet published are listed and the command fails
+if there are any, after updating the published ones.  If the published
+version of a dep. is lower than the one in package.json nothing is
+changed unless --force is given.
+
+The -p option is the same as for the 'published' command.  Only gx
+packages are supported.
+` + reqGxUpdateState,
+	Run: updateDepsCmdRun,
+}
+
+func updateDepsCmdRun() error {
+	if len(args) != 0 {
+		return UsageErr()
+	}
+	_, byName, err := GetTodo()
+	if err != nil {
+		return err
+	}
+	fn := "package.json"
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	pkg := &PackageFile{}
+	err = json.Unmarshal(data, pkg)
+	if err != nil {
+		return err
+	}
+	todo, err := byName.FindCurrent(pkg.Name, curCmd.String("pkg", ""))
+	if err != nil {
+		return err
+	}
+	if todo.backend != GxBackend {
+		return fmt.Errorf("update-deps only supports gx packages")
+	}
+	entries, err := ParseDepEntries(data)
+	if err != nil {
+		return err
+	}
+	unpublished := []string{}
+	downgrades := []string{}
+	changes := []string{}
+	for _, entry := range entries {
+		id, ok := todo.DepId(entry.Name)
+		if !ok {
+			continue
+		}
+		dep := byName[id]
+		if !dep.Published {
+			unpublished = append(unpublished, id)
+			continue
+		}
+		if entry.Hash == dep.NewHash {
+			continue
+		}
+		if CompareVersions(dep.NewVersion, entry.Version) < 0 {
+			downgrades = append(downgrades, fmt.Sprintf("%s %s -> %s", id, entry.Version, dep.NewVersion))
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s (%s) -> %s (%s)", id, entry.Hash, entry.Version, dep.NewHash, dep.NewVersion))
+		entry.Hash = dep.NewHash
+		entry.Version = dep.NewVersion
+	}
+	if len(downgrades) > 0 {
+		lst := strings.Join(downgrades, "\n  ")
+		if !curCmd.Flag("force") {
+			return fmt.Errorf("would downgrade:\n  %s\nuse --force to update anyway", lst)
+		}
+		fmt.Fprintf(os.Stderr, "warning: downgrading:\n  %s\n", lst)
+	}
+	dryRun := curCmd.Flag("dry-run")
+	if len(changes) > 0 && !dryRun {
+		data, err = SetDepEntries(data, entries)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+		err = WriteFileAtomic(fn, data, fi.Mode().Perm(), true)
+		if err != nil {
+			return err
+		}
+	}
+	// only shown once written, or with -n what would have been
+	for _, change := range changes {
+		fmt.Printf("%s\n", change)
+	}
+	switch {
+	case len(changes) == 0:
+		fmt.Printf("nothing to update\n")
+	case dryRun:
+		fmt.Printf("dry run, %s not changed\n", fn)
+	}
+	if len(unpublished) > 0 {
+		return fmt.Errorf("unpublished deps.: %s", strings.Join(unpublished, " "))
+	}
+	return nil
+}
+
+var verifyCmd = Command{
+	Name:    "verify",
+	Tagline: "Check that the packages on disk agree with the state",
+	Help: `
+Check that the package.json and .gx/lastpubver of each package in the
+session, as found in '$dir', agree with the state.  For packages that
+are marked as published the hash and version must match what was
+recorded by the 'published' command, as must the hashes of the deps.
+Packages not marked as published must not have been published since
+the session was started.
+
+Each difference found is listed and the command fails if there are
+any, so it can be used before a release.
+` + reqGxUpdateState,
+	Run: verifyCmdRun,
+}
+
+func verifyCmdRun() error {
+	if len(args) != 0 {
+		return UsageErr()
+	}
+	lst, _, err := GetTodo()
 	if err != nil {
 		return err
 	}
+	src := NewSource(lst[0].backend, filepath.Dir(os.Getenv("GX_UPDATE_STATE")))
+	drifted := 0
+	for _, todo := range lst {
+		diffs := todo.Drift(src)
+		for _, diff := range diffs {
+			fmt.Printf("%s: %s\n", todo.Key(), diff)
+		}
+		if len(diffs) > 0 {
+			drifted++
+		}
+	}
+	if drifted > 0 {
+		return fmt.Errorf("%d of %d packages do not agree with the state", drifted, len(lst))
+	}
+	fmt.Printf("all %d packages agree with the state\n", len(lst))
 	return nil
 }
 
+var watchCmd = Command{
+	Name:    "watch",
+	Tagline: "Record publishes as they happen",
+	Opts: []*Opt{
+		{Short: "i", Long: "interval", Type: IntOpt, Arg: "secs", Help: "seconds between checks, defaults to 2"},
+	},
+	Help: `
+Watch the directories of all packages in the session and record any
+new publish, as done by 'published --scan', as it happens.  A line is
+printed for each package published or invalidated, along with the
+number of packages that are now ready.
+
+Only the publishes made while watching are recorded, use 'published
+--scan' for the ones made before.  A package that is no longer marked,
+for example due to 'published reset' or 'undo', is not marked again
+until it is published again.
+
+The command keeps running until interrupted.  The state is only locked
+while it is being updated so other commands can be used at the same
+time.
+` + reqGxUpdateState,
+	Run: watchCmdRun,
+}
+
+func watchCmdRun() error {
+	if len(args) != 0 {
+		return UsageErr()
+	}
+	interval := curCmd.Int("interval", 2)
+	if interval < 1 {
+		return fmt.Errorf("-i must be at least 1")
+	}
+	// make sure there is a session before starting
+	lst, _, err := GetTodo()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("watching %d packages, press Ctrl-C to stop\n", len(lst))
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	lastErr := ""
+	seen := map[string]Hash{}
+	for {
+		// the state is never written while waiting so it is safe to
+		// stop here
+		lines, err := WatchOnce(seen)
+		// only show an error when it changes rather than every time
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+		}
+		if errStr != "" && errStr != lastErr {
+			fmt.Fprintf(os.Stderr, "error: %s\n", errStr)
+		}
+		lastErr = errStr
+		for _, line := range lines {
+			fmt.Printf("%s %s\n", time.Now().Format("15:04:05"), line)
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
 var toPinCmd = Command{
 	Name:    "to-pin",
 	Tagline: "list the pins of packages once done",
-	Usage:   "to-pin -f <fmtstr>",
+	Opts:    []*Opt{fmtOpt("format of each pin")},
 	Help: `
 List the pins of all packages once done.  It will return an error if
 all but the last package is not yet publicized.
@@ -596,19 +1047,12 @@ The default value for -f is '$hash $path $version'
 }
 
 func toPinCmdRun() error {
-	var ok bool
-	fmtstr := "$hash $path $version"
-	for len(args) > 0 {
-		arg, _ := Shift()
-		switch arg {
-		case "-f":
-			fmtstr, ok = Shift()
-			if !ok {
-				return UsageErr()
-			}
-		default:
-			return UsageErr()
-		}
+	fmtstr := curCmd.String("format", "$hash $path $version")
+	if err := CheckFormat(&Todo{}, fmtstr); err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return UsageErr()
 	}
 	todoList, _, err := GetTodo()
 	if err != nil {
@@ -626,7 +1070,7 @@ func toPinCmdRun() error {
 			// ^^ ignore very last item in the list as it the final
 			// target and does not necessary need to be gx
 			// published
-			unpublished = append(unpublished, todo.Name)
+			unpublished = append(unpublished, todo.Key())
 		}
 	}
 	if len(unpublished) > 0 {
@@ -638,12 +1082,14 @@ func toPinCmdRun() error {
 var metaCmd = Command{
 	Name:    "meta",
 	Tagline: "Change the state of meta-data for a package.",
-	Usage:   "meta [-p <pkg>] get|set|unset|vals|default ...",
+	Opts:    []*Opt{pkgOpt("package to use instead of the current package")},
+	Args:    "get|set|unset|vals|default ...",
 	Help: `
 Manipulate the state of meta-data for a package.
 
-The current package is used unless the '-p' option is given.  The
-following subcommands are provided:
+The current package is used unless the '-p' option is given, see the
+'deps' command for how to select between multiple versions of a
+package.  The following subcommands are provided:
 
   get <key>
   unset <key> <val>
@@ -655,68 +1101,699 @@ following subcommands are provided:
 }
 
 func metaCmdRun() error {
-	lst, byName, err := GetTodo()
-	if err != nil {
-		return err
-	}
 	arg, ok := Shift()
 	if !ok {
 		return UsageErr()
 	}
-	pkgName := ""
-	notUsed := make([]string, 0, len(args))
-	for len(args) > 0 {
-		arg, _ := Shift()
-		if arg == "-p" {
-			arg, ok := Shift()
-			if !ok {
-				return UsageErr()
-			}
-			pkgName = arg
-		} else {
-			notUsed = append(notUsed, arg)
-		}
+	// only lock the state if it may be changed
+	sub := arg
+	if arg == "default" && len(args) > 0 {
+		sub = args[0]
+	}
+	getTodo := GetTodo
+	if sub == "set" || sub == "unset" {
+		getTodo = GetTodoLocked
+	}
+	lst, byName, err := getTodo()
+	if err != nil {
+		return err
 	}
-	args = notUsed
+	pkgName := curCmd.String("pkg", "")
 	modified := false
+	desc := ""
+	var event func() LogEntry
 	if arg == "default" {
 		arg, ok := Shift()
 		if !ok {
 			return fmt.Errorf("usage: %s meta default get|set|unset|vals ...", os.Args[0])
 		}
+		desc = strings.Join(append([]string{"meta default", arg}, args...), " ")
+		event = metaEvent(lst[0].defaults, "")
 		modified, err = getSetEtc(arg, lst[0].defaults, nil, "meta default")
 		if err != nil {
 			return err
 		}
 	} else {
 		if pkgName == "" {
-			pkg, err := ReadPackage(".")
+			pkg, err := NewSource(lst[0].backend, "").ReadPackage(".")
 			if err != nil {
 				return err
 			}
 			pkgName = pkg.Name
 		}
-		todo, ok := byName[pkgName]
-		if !ok {
-			return fmt.Errorf("could not find entry for %s", pkgName)
+		todo, err := byName.Find(pkgName)
+		if err != nil {
+			return err
 		}
 		if todo.Meta == nil {
 			todo.Meta = map[string]string{}
 		}
+		desc = fmt.Sprintf("%s (%s)", strings.Join(append([]string{"meta", arg}, args...), " "), todo.Key())
+		event = metaEvent(todo.Meta, todo.Key())
 		modified, err = getSetEtc(arg, todo.Meta, todo.defaults, "meta")
 		if err != nil {
 			return err
 		}
 	}
 	if modified {
-		err = lst.Write()
+		err = lst.Write(desc, event())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var graphCmd = Command{
+	Name:    "graph",
+	Tagline: "Output the reverse dep. graph as DOT or Mermaid",
+	Opts: []*Opt{
+		{Long: "dot", Help: "output the graph in the DOT format (the default)"},
+		{Long: "mermaid", Help: "output the graph as a Mermaid flowchart"},
+		fmtOpt("format of the node labels"),
+	},
+	Help: `
+Output the reverse dependency graph of the session in the Graphviz DOT
+format, or as a Mermaid flowchart if --mermaid is given.  The edges
+go from a package to the packages that depend on it.  Solid edges are
+for the direct deps. ($deps) and dashed edges are for the deps. that
+also need to be updated ('deps also').
+
+The nodes are grouped by level and colored by state: green if
+published, red if invalidated, yellow if ready and gray otherwise.
+
+The -f option can be used to customize the node labels and defaults
+to '$name'.
+` + FormatHelp(AllKeys) + `
+EXAMPLES
+
+To render the graph as an image:
+  gx-update-helper graph | dot -Tpng > graph.png
+` + reqGxUpdateState,
+	Run: graphCmdRun,
+}
+
+func graphCmdRun() error {
+	mode := "dot"
+	if curCmd.Flag("mermaid") {
+		mode = "mermaid"
+	}
+	fmtstr := curCmd.String("format", "$name")
+	if err := CheckFormat(&Todo{}, fmtstr); err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return UsageErr()
+	}
+	lst, byName, err := GetTodo()
+	if err != nil {
+		return err
+	}
+	var out []byte
+	if mode == "mermaid" {
+		out, err = GraphMermaid(lst, byName, fmtstr)
+	} else {
+		out, err = GraphDot(lst, byName, fmtstr)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+var whyCmd = Command{
+	Name:    "why",
+	Tagline: "Explain why <pkg> needs to be updated",
+	Opts: append(backendOpts(),
+		&Opt{Long: "shortest", Help: "only print the shortest path"},
+		&Opt{Short: "n", Long: "max", Type: IntOpt, Arg: "n", Help: "print at most <n> paths, defaults to 20"}),
+	Args: "<pkg> [<dep>...]",
+	Help: `
+Explain why <pkg> needs to be updated by printing every path through
+the direct deps. from <pkg> down to <dep>, along with the hashes of
+the packages along each path.  As there can be a very large number of
+paths at most 20 are printed unless -n is given.  If --shortest is
+given only the shortest path is printed.
+
+If no <dep> is given the targets of the current session are used,
+otherwise the deps. are gathered from the package in the current
+directory as done by 'preview'.  The --gx and --mod options are the
+same as for 'preview'.
+`,
+	Run: whyCmdRun,
+}
+
+func whyCmdRun() error {
+	shortest := curCmd.Flag("shortest")
+	limit := curCmd.Int("max", 20)
+	if limit < 1 {
+		return fmt.Errorf("-n must be at least 1")
+	}
+	names := args
+	if len(names) == 0 {
+		return UsageErr()
+	}
+	pkgName, targetNames := names[0], names[1:]
+	var src PackageSource
+	if len(targetNames) == 0 {
+		lst, _, err := GetTodo()
+		if err != nil {
+			return err
+		}
+		src = NewSource(lst[0].backend, filepath.Dir(os.Getenv("GX_UPDATE_STATE")))
+		targetNames = lst.Targets()
+	} else {
+		backend, err := backend()
+		if err != nil {
+			return err
+		}
+		src = NewSource(backend, ".")
+	}
+	pkgs, _, err := Gather(src, targetNames...)
+	if err != nil {
+		return err
+	}
+	targets := []Hash{}
+	for _, name := range targetNames {
+		found, err := pkgs.Select(name)
+		if err != nil {
+			return err
+		}
+		for _, pkg := range found {
+			targets = append(targets, pkg.Hash)
+		}
+	}
+	found, err := pkgs.Select(pkgName)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range found {
+		var paths [][]Hash
+		more := false
+		if shortest {
+			if path := pkgs.ShortestPath(pkg.Hash, targets); path != nil {
+				paths = append(paths, path)
+			}
+		} else {
+			paths, more = pkgs.Paths(pkg.Hash, targets, limit)
+		}
+		if len(paths) == 0 {
+			return fmt.Errorf("%s does not depend on %s", pkgName, strings.Join(targetNames, " "))
+		}
+		for _, path := range paths {
+			fmt.Printf("%s\n", pkgs.PathString(path))
+		}
+		if more {
+			fmt.Printf("... more than %d paths, use -n to show more\n", limit)
+		}
+	}
+	return nil
+}
+
+var nextCmd = Command{
+	Name:    "next",
+	Tagline: "Show the next package to update",
+	Opts:    []*Opt{fmtOpt("format of the package shown")},
+	Help: `
+Show the directory of the next package to update.  Of the packages that
+are ready the one that will make the most other packages ready once
+published is chosen, ties are broken by level and then by name.  If
+nothing is ready an explanation of why is printed and the command
+fails.
+
+The -f option can be used to customize the output and defaults to
+'$dir'.
+` + FormatHelp(AllKeys) + `
+See also the 'shell-init' command.
+` + reqGxUpdateState,
+	Run: nextCmdRun,
+}
+
+func nextCmdRun() error {
+	fmtstr := curCmd.String("format", "$dir")
+	if err := CheckFormat(&Todo{}, fmtstr); err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return UsageErr()
+	}
+	lst, byName, err := GetTodo()
+	if err != nil {
+		return err
+	}
+	UpdateState(lst, byName)
+	todo := lst.Next()
+	if todo == nil {
+		waiting := []string{}
+		for _, todo := range lst {
+			if !todo.Published {
+				waiting = append(waiting, fmt.Sprintf("  %s :: %s", todo.Key(), strings.Join(todo.UnmetDeps, " ")))
+			}
+		}
+		noDir := []string{}
+		for _, todo := range lst {
+			if _, ok := todo.LocalDir(); todo.Ready && !ok {
+				noDir = append(noDir, todo.Key())
+			}
+		}
+		if len(noDir) > 0 {
+			return fmt.Errorf("nothing is ready with a local checkout, ready without one: %s", strings.Join(noDir, " "))
+		}
+		if len(waiting) == 0 {
+			return fmt.Errorf("nothing is ready, all packages are published")
+		}
+		return fmt.Errorf("nothing is ready, waiting on unmet deps.:\n%s", strings.Join(waiting, "\n"))
+	}
+	str, err := todo.Format(fmtstr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", str)
+	return nil
+}
+
+var execCmd = Command{
+	Name:    "exec",
+	Tagline: "Run a command in the directory of each package",
+	Opts: []*Opt{
+		{Long: "ready", Help: "only run for the packages that are ready"},
+		{Long: "all", Help: "run for all packages (the default)"},
+		{Short: "k", Long: "keep-going", Help: "continue with the other packages if the command fails"},
+		{Short: "j", Long: "jobs", Type: IntOpt, Arg: "n", Help: "run up to <n> commands at once"},
+	},
+	Args: "[[not] <cond>] -- <cmd> [<arg>...]",
+	Help: `
+Run <cmd> in the directory of each package in the session, in the
+order of the levels in the reverse dep. graph.  If <cond> is given,
+as for the 'list' command, only the packages matching it are used,
+--ready is the same as using the 'ready' condition.  Go modules
+without a local replace have no directory and are skipped.
+
+The format variables in <cmd> and its arguments are expanded for each
+package, see below, so they normally need to be quoted.  Any argument
+containing a '${' is formatted as a whole, the others, such as
+'echo $HOME', are passed as is, so use '${name}' rather than '$name'.
+In a formatted argument every '$' starts a format variable, so an
+unescaped '$GXU_NAME' or '$HOME' fails as an undefined variable rather
+than being passed to the shell, escape the '$' with a backslash,
+'\$HOME', to pass it as is.
+
+The variables are also exported as environmental variables named
+GXU_<VAR> in upper case, for example GXU_NAME, GXU_DIR and GXU_VER.
+Only the main name of a variable is used, so there is no GXU_VERSION,
+and the variables that are undefined for a package are not exported.
+
+By default nothing more is run once <cmd> fails for a package, the
+-k option continues with the other packages instead, except for the
+ones that depend on a package it failed for.  With -j more
+than one command is run at once, a package is started once <cmd> is
+done for all of its deps. in the session, and the output of each
+command is shown when it is done.
+
+A summary of which packages passed or failed is printed at the end
+and the command fails if <cmd> failed for any package.
+
+The state is not locked while <cmd> runs so it can use this tool, for
+example to mark a package as published.
+` + FormatHelp(AllKeys) + `
+EXAMPLES
+
+To run the tests of all packages that are ready:
+  gx-update-helper exec --ready -- go test ./...
+
+To show the version of each published package:
+  gx-update-helper exec published -- sh -c 'echo ${name} \$GXU_VER'
+
+To show the level of each package, nothing is formatted so the
+exported variable can be used as is:
+  gx-update-helper exec -- sh -c 'echo $GXU_NAME $GXU_LEVEL'
+` + reqGxUpdateState,
+	Run: execCmdRun,
+}
+
+func execCmdRun() error {
+	if dashArgs == -1 || dashArgs == len(args) {
+		return UsageErr()
+	}
+	cond, invert, ok := parseCond(args[:dashArgs])
+	if !ok {
+		return UsageErr()
+	}
+	argv := args[dashArgs:]
+	switch {
+	case curCmd.Flag("ready") && (cond != "" || curCmd.Flag("all")):
+		return UsageErr()
+	case curCmd.Flag("ready"):
+		cond = "ready"
+	case curCmd.Flag("all") && cond != "":
+		return UsageErr()
+	}
+	for _, arg := range argv {
+		if !IsFormatArg(arg) {
+			continue
+		}
+		if err := CheckFormat(&Todo{}, arg); err != nil {
+			return err
+		}
+	}
+	jobs := curCmd.Int("jobs", 1)
+	if jobs < 1 {
+		return fmt.Errorf("-j must be at least 1")
+	}
+	lst, _, err := GetTodo()
+	if err != nil {
+		return err
+	}
+	sel := TodoList{}
+	noDir := []string{}
+	for _, todo := range lst {
+		ok := true
+		if cond != "" {
+			_, ok, _ = todo.Get(cond)
+		}
+		if ok == invert {
+			continue
+		}
+		if _, ok := todo.LocalDir(); !ok {
+			noDir = append(noDir, todo.Key())
+			continue
+		}
+		sel = append(sel, todo)
+	}
+	if len(noDir) > 0 {
+		fmt.Fprintf(os.Stderr, "skipping, no local checkout: %s\n", strings.Join(noDir, " "))
+	}
+	if len(sel) == 0 {
+		return fmt.Errorf("no packages to run the command for")
+	}
+	passed, failed, skipped := ExecAll(sel, argv, jobs, curCmd.Flag("keep-going"))
+	fmt.Printf("\n")
+	for _, res := range []struct {
+		what string
+		lst  TodoList
+	}{{"passed", passed}, {"failed", failed}, {"not run", skipped}} {
+		if len(res.lst) > 0 {
+			fmt.Printf("%s: %s\n", res.what, strings.Join(keys(res.lst), " "))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("command failed for %d of %d packages", len(failed), len(sel))
+	}
+	return nil
+}
+
+var cacheCmd = Command{
+	Name:    "cache",
+	Tagline: "Manage the cache of gx packages",
+	Args:    "clear|stats",
+	Help: `
+Manage the persistent cache of gx packages.  As a gx hash never
+changes the name, version, dvcsimport and deps. of each package read
+are kept in a cache so that they don't need to be read again by
+'preview', 'init' and the other commands that gather the deps.  The
+cache is kept in $XDG_CACHE_HOME/gx-update-helper, or
+~/.cache/gx-update-helper if not set.
+
+The 'stats' subcommand shows where the cache is and how many entries
+it has, and 'clear' removes all entries.
+`,
+	Run: cacheCmdRun,
+}
+
+func cacheCmdRun() error {
+	what, ok := Shift()
+	if !ok || len(args) != 0 {
+		return UsageErr()
+	}
+	dir, err := CacheDir()
+	if err != nil {
+		return err
+	}
+	switch what {
+	case "stats":
+		entries, size, err := CacheStats(dir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("location: %s\n", dir)
+		fmt.Printf("entries: %d\n", entries)
+		fmt.Printf("size: %d bytes\n", size)
+	case "clear":
+		entries, _, err := CacheStats(dir)
+		if err != nil {
+			return err
+		}
+		err = os.RemoveAll(dir)
 		if err != nil {
 			return err
 		}
+		fmt.Printf("removed %d entries\n", entries)
+	default:
+		return UsageErr()
+	}
+	return nil
+}
+
+var shellInitCmd = Command{
+	Name:    "shell-init",
+	Tagline: "Output shell functions for navigating a session",
+	Args:    "[bash|zsh]",
+	Help: `
+Output shell functions for navigating a session, for bash or zsh
+(the default is bash).  To use add the following to your shell's
+startup file:
+  eval "$(gx-update-helper shell-init bash)"
+
+The following functions are defined:
+  gxu-next: change to the directory of the next package to update,
+            see the 'next' command
+  gxu-root: change to the root directory of the current session
+`,
+	Run: shellInitCmdRun,
+}
+
+func shellInitCmdRun() error {
+	shell := "bash"
+	if len(args) > 0 {
+		shell, _ = Shift()
+	}
+	if len(args) != 0 || shell != "bash" && shell != "zsh" {
+		return UsageErr()
+	}
+	// the same functions work for both bash and zsh
+	fmt.Printf(`gxu-next() {
+  local dir
+  dir="$(%[1]s next)" || return
+  cd "$dir"
+}
+gxu-root() {
+  if [ -z "$GX_UPDATE_STATE" ]; then
+    echo "GX_UPDATE_STATE not set" >&2
+    return 1
+  fi
+  cd "$(dirname "$GX_UPDATE_STATE")"
+}
+`, shellQuote(os.Args[0]))
+	return nil
+}
+
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
+
+var completionCmd = Command{
+	Name:    "completion",
+	Tagline: "Output a shell completion script",
+	Args:    "bash|zsh|fish",
+	Help: `
+Output a completion script for bash, zsh or fish.  Sub-commands and
+their options and arguments are completed, as are package names for
+the '-p' option and meta-data keys, which are read from the current
+session.
+
+To enable for bash add the following to ~/.bashrc:
+  source <(gx-update-helper completion bash)
+
+For zsh write the output to a file named _gx-update-helper somewhere in
+your $fpath, and for fish to
+~/.config/fish/completions/gx-update-helper.fish.
+`,
+}
+
+func init() {
+	// set here to avoid an initialization cycle as the completions
+	// are generated from cmds
+	completionCmd.Run = completionCmdRun
+}
+
+func completionCmdRun() error {
+	shell, ok := Shift()
+	if !ok || len(args) != 0 {
+		return UsageErr()
+	}
+	switch shell {
+	case "bash":
+		fmt.Print(CompletionBash(os.Args[0]))
+	case "zsh":
+		fmt.Print(CompletionZsh(os.Args[0]))
+	case "fish":
+		fmt.Print(CompletionFish(os.Args[0]))
+	default:
+		return UsageErr()
 	}
 	return nil
 }
 
+var completeCmd = Command{
+	Name:   "__complete",
+	Args:   "pkgs|keys|conds",
+	Hidden: true,
+	Run: func() error {
+		what, ok := Shift()
+		if !ok || len(args) != 0 {
+			return UsageErr()
+		}
+		vals, err := CompleteValues(what)
+		if err != nil {
+			return err
+		}
+		for _, val := range vals {
+			fmt.Printf("%s\n", val)
+		}
+		return nil
+	},
+}
+
+var undoCmd = Command{
+	Name:    "undo",
+	Tagline: "Undo the last change to the state",
+	Help: `
+Undo the last change to the state made by the 'published', 'meta' or
+'refresh' commands and print what was reverted.  The previous states
+are kept in a journal next to the state file, up to 20 changes can be
+undone.
+` + reqGxUpdateState,
+	Run: func() error {
+		return undoCmdRun(false)
+	},
+}
+
+var redoCmd = Command{
+	Name:    "redo",
+	Tagline: "Redo the last undone change to the state",
+	Help: `
+Redo the last change to the state undone with the 'undo' command.  Any
+new change to the state discards the changes that can be redone.
+` + reqGxUpdateState,
+	Run: func() error {
+		return undoCmdRun(true)
+	},
+}
+
+var logCmd = Command{
+	Name:    "log",
+	Tagline: "Show the history of changes to the state",
+	Opts: []*Opt{
+		fmtOpt("format of each entry"),
+		pkgOpt("only show the events for <pkg>"),
+	},
+	Args: "[<event>...]",
+	Help: `
+Show the history of changes to the state.  Every change made by the
+'published', 'meta', 'refresh', 'undo' and 'redo' commands is logged
+with a timestamp and the git user who made it.  A package becoming
+invalidated is also logged.
+
+The '-p' option limits the output to events for a specific package.
+If any <event> is given only those events are shown.
+
+The -f option can be used to customize the output.  It defaults to
+'$time $event[ $name][ $key][ $old ->][ $new][ ($user)]'.
+` + FormatHelp(LogKeys) + reqGxUpdateState,
+	Run: logCmdRun,
+}
+
+func logCmdRun() error {
+	fmtstr := curCmd.String("format", "$time $event[ $name][ $key][ $old ->][ $new][ ($user)]")
+	if err := CheckFormat(&LogEntry{}, fmtstr); err != nil {
+		return err
+	}
+	pkgName := curCmd.String("pkg", "")
+	events := NameSet{}
+	for _, arg := range args {
+		known := false
+		for _, event := range LogEvents {
+			known = known || arg == event
+		}
+		if !known {
+			return fmt.Errorf("unknown event: %s", arg)
+		}
+		events.Add(arg)
+	}
+	fn := os.Getenv("GX_UPDATE_STATE")
+	if fn == "" {
+		return fmt.Errorf("GX_UPDATE_STATE not set")
+	}
+	entries, err := ReadLog(fn)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Matches(events, pkgName) {
+			continue
+		}
+		str, err := Format(&entry, fmtstr)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", str)
+	}
+	return nil
+}
+
+func undoCmdRun(redo bool) error {
+	if len(args) != 0 {
+		return UsageErr()
+	}
+	fn := os.Getenv("GX_UPDATE_STATE")
+	if fn == "" {
+		return fmt.Errorf("GX_UPDATE_STATE not set")
+	}
+	desc, err := Undo(fn, redo)
+	if err != nil {
+		return err
+	}
+	event := LogEntry{Event: "undo", New: desc}
+	if redo {
+		event.Event = "redo"
+	}
+	err = AppendLog(fn, event)
+	if err != nil {
+		return err
+	}
+	if redo {
+		fmt.Printf("reapplied: %s\n", desc)
+	} else {
+		fmt.Printf("reverted: %s\n", desc)
+	}
+	return nil
+}
+
+// metaEvent records the current value of the key about to be
+// modified, the returned function creates the event once it has been
+// modified
+func metaEvent(vals map[string]string, pkgName string) func() LogEntry {
+	key := ""
+	if len(args) > 0 {
+		key = args[0]
+	}
+	old := vals[key]
+	return func() LogEntry {
+		return LogEntry{Event: "meta", Package: pkgName, Key: key, Old: old, New: vals[key]}
+	}
+}
+
 func getSetEtc(arg string, vals map[string]string, defaults map[string]string, prefix string) (modified bool, err error) {
 	switch arg {
 	case "get":
@@ -745,8 +1822,11 @@ func getSetEtc(arg string, vals map[string]string, defaults map[string]string, p
 		if err != nil {
 			return
 		}
-		vals[key] = val
-		modified = true
+		// nothing is written, or journaled, if unchanged
+		if prev, ok := vals[key]; !ok || prev != val {
+			vals[key] = val
+			modified = true
+		}
 	case "unset":
 		key, ok := Shift()
 		if !ok || len(args) != 0 {
@@ -757,8 +1837,10 @@ func getSetEtc(arg string, vals map[string]string, defaults map[string]string, p
 		if err != nil {
 			return
 		}
-		delete(vals, key)
-		modified = true
+		if _, ok := vals[key]; ok {
+			delete(vals, key)
+			modified = true
+		}
 	case "vals":
 		for k, v := range vals {
 			fmt.Printf("%s %s\n", k, v)
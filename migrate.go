@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// StateVersion is the version of the state file layout written by
+// this release.  Bump it and add a migration whenever the layout
+// changes in a way older sessions can't be read as is.  New fields
+// whose zero value keeps the old behavior, such as Todo.OrigVersion,
+// don't need a migration.
+const StateVersion = 1
+
+// migrations[i] upgrades a state file from version i to version i+1.
+// The migrations operate on the raw JSON so that they do not depend
+// on the current layout of JsonState.
+var migrations = []func(state map[string]interface{}) error{
+	migrateV0,
+}
+
+// version 0 did not record the targets of the session, the targets
+// were always the entries at level 0
+func migrateV0(state map[string]interface{}) error {
+	todos, _ := state["Todo"].([]interface{})
+	targets := []interface{}{}
+	for _, v := range todos {
+		todo, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("bad todo entry")
+		}
+		if level, _ := todo["Level"].(float64); level == 0 {
+			targets = append(targets, todo["Name"])
+		}
+	}
+	for _, v := range todos {
+		todo := v.(map[string]interface{})
+		if _, ok := todo["Targets"]; !ok {
+			todo["Targets"] = targets
+		}
+	}
+	return nil
+}
+
+// DecodeState decodes the state file upgrading it to the current
+// layout if necessary
+func DecodeState(bytes []byte) (state JsonState, err error) {
+	raw := map[string]interface{}{}
+	err = json.Unmarshal(bytes, &raw)
+	if err != nil {
+		return
+	}
+	version := 0
+	if v, ok := raw["Version"].(float64); ok {
+		version = int(v)
+	}
+	if version > StateVersion {
+		err = fmt.Errorf("state file is version %d but only up to version %d is supported, it was likely written by a newer release of gx-update-helper", version, StateVersion)
+		return
+	}
+	if version == StateVersion {
+		err = json.Unmarshal(bytes, &state)
+		return
+	}
+	for ; version < StateVersion; version++ {
+		err = migrations[version](raw)
+		if err != nil {
+			err = fmt.Errorf("could not upgrade state file from version %d: %s", version, err.Error())
+			return
+		}
+	}
+	raw["Version"] = StateVersion
+	bytes, err = json.Marshal(raw)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(bytes, &state)
+	return
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readState(t *testing.T, fn string) (JsonState, error) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DecodeState(data)
+}
+
+func TestMigrateV0(t *testing.T) {
+	state, err := readState(t, "state-v0.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != StateVersion {
+		t.Errorf("got version %d, expected %d", state.Version, StateVersion)
+	}
+	if len(state.Todo) != 4 {
+		t.Fatalf("got %d entries, expected 4", len(state.Todo))
+	}
+	// the targets were the entries at level 0
+	targets := []string{"go-cid", "go-log"}
+	for _, todo := range state.Todo {
+		if !reflect.DeepEqual(todo.Targets, targets) {
+			t.Errorf("%s: got targets %v, expected %v", todo.Name, todo.Targets, targets)
+		}
+	}
+	// everything else is kept as is
+	cid, format := state.Todo[0], state.Todo[2]
+	if cid.NewHash != "QmCid2" || cid.NewVersion != "0.9.1" || !cid.Published {
+		t.Errorf("go-cid: published state not kept: %+v", cid)
+	}
+	if format.Meta["pr"] != "12" || !reflect.DeepEqual(format.Deps, []string{"go-cid"}) {
+		t.Errorf("go-ipld-format: not kept: %+v", format)
+	}
+	if state.Defaults["pr"] != "none" {
+		t.Errorf("defaults not kept: %v", state.Defaults)
+	}
+
+	// the migrated state reads back as is
+	fn := filepath.Join(t.TempDir(), "state.json")
+	if err := WriteStateFile(fn, state, 0644, false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := DecodeState(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, state) {
+		t.Errorf("got %+v after writing, expected %+v", again, state)
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	_, err := readState(t, "state-future.json")
+	if err == nil || !strings.Contains(err.Error(), "newer release") {
+		t.Errorf("expected a newer version to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type OptType int
+
+const (
+	FlagOpt   OptType = iota // takes no value
+	StringOpt                // takes a string value
+	IntOpt                   // takes an integer value
+)
+
+// Opt describes an option accepted by a command.  An option can have
+// a short form, '-f <val>', a long form, '--format <val>' or
+// '--format=<val>', or both.
+type Opt struct {
+	Short  string // a single letter without the leading '-'
+	Long   string // without the leading '--'
+	Type   OptType
+	Arg    string // name of the value shown in the usage
+	Repeat bool   // may be given more than once
+	Help   string
+
+	vals []string // set by Parse
+}
+
+func (o *Opt) names() []string {
+	names := []string{}
+	if o.Short != "" {
+		names = append(names, "-"+o.Short)
+	}
+	if o.Long != "" {
+		names = append(names, "--"+o.Long)
+	}
+	return names
+}
+
+func (o *Opt) name() string {
+	return strings.Join(o.names(), "|")
+}
+
+func (o *Opt) set(val string) error {
+	if len(o.vals) > 0 && !o.Repeat {
+		return fmt.Errorf("%s given more than once", o.name())
+	}
+	if o.Type == IntOpt {
+		if _, err := strconv.Atoi(val); err != nil {
+			return fmt.Errorf("%s: expected an integer, got: %s", o.name(), val)
+		}
+	}
+	o.vals = append(o.vals, val)
+	return nil
+}
+
+func (c *Command) findOpt(arg string) *Opt {
+	for _, o := range c.Opts {
+		if o.Short != "" && arg == "-"+o.Short || o.Long != "" && arg == "--"+o.Long {
+			return o
+		}
+	}
+	return nil
+}
+
+// the index in args of the first argument after '--', or -1 if '--'
+// was not given
+var dashArgs = -1
+
+// Parse parses the options in argv, the remaining arguments are
+// stored in args.  Options and arguments may be mixed, and '--' ends
+// the options so that an argument starting with a '-' can be given,
+// a negative number is also taken as an argument.  Short options may
+// be grouped, '-kn' is the same as '-k -n', and the first one in a
+// group that takes a value uses the rest of the group as its value,
+// so '-kj4' is the same as '-k -j 4'.  If the help option is given
+// showHelp is set.
+func (c *Command) Parse(argv []string) (showHelp bool, err error) {
+	for _, o := range c.Opts {
+		o.vals = nil
+	}
+	args = []string{}
+	dashArgs = -1
+	for len(argv) > 0 {
+		arg := argv[0]
+		argv = argv[1:]
+		if arg == "--" {
+			dashArgs = len(args)
+			args = append(args, argv...)
+			break
+		}
+		if arg == "-h" || arg == "--help" {
+			showHelp = true
+			continue
+		}
+		if len(arg) < 2 || arg[0] != '-' || isNumber(arg) {
+			args = append(args, arg)
+			continue
+		}
+		if len(arg) > 2 && arg[1] != '-' {
+			argv, showHelp, err = c.parseGroup(arg, argv, showHelp)
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+		val, hasVal := "", false
+		if i := strings.IndexByte(arg, '='); i != -1 && strings.HasPrefix(arg, "--") {
+			arg, val, hasVal = arg[:i], arg[i+1:], true
+		}
+		o := c.findOpt(arg)
+		if o == nil {
+			return false, unknownOpt(arg, c)
+		}
+		switch {
+		case o.Type == FlagOpt && hasVal:
+			return false, fmt.Errorf("%s does not take a value", arg)
+		case o.Type == FlagOpt:
+			val = "true"
+		case !hasVal && len(argv) == 0:
+			return false, fmt.Errorf("%s requires a value\n%s", arg, c.UsageErr())
+		case !hasVal:
+			val = argv[0]
+			argv = argv[1:]
+		}
+		err = o.set(val)
+		if err != nil {
+			return false, err
+		}
+	}
+	return
+}
+
+// parseGroup parses a group of short options, or a short option with
+// its value attached, and returns the arguments that are left
+func (c *Command) parseGroup(arg string, argv []string, showHelp bool) ([]string, bool, error) {
+	for i := 1; i < len(arg); i++ {
+		short := "-" + arg[i:i+1]
+		if short == "-h" {
+			showHelp = true
+			continue
+		}
+		o := c.findOpt(short)
+		if o == nil {
+			return nil, false, unknownOpt(short, c)
+		}
+		if o.Type == FlagOpt {
+			if err := o.set("true"); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		val := arg[i+1:]
+		if val == "" {
+			if len(argv) == 0 {
+				return nil, false, fmt.Errorf("%s requires a value\n%s", short, c.UsageErr())
+			}
+			val, argv = argv[0], argv[1:]
+		}
+		return argv, showHelp, o.set(val)
+	}
+	return argv, showHelp, nil
+}
+
+func isNumber(arg string) bool {
+	_, err := strconv.ParseFloat(arg, 64)
+	return err == nil
+}
+
+func unknownOpt(arg string, c *Command) error {
+	return fmt.Errorf("unknown option: %s, use '--' before any argument starting with a '-'\n%s", arg, c.UsageErr())
+}
+
+func (c *Command) opt(name string) *Opt {
+	for _, o := range c.Opts {
+		if name == o.Short || name == o.Long {
+			return o
+		}
+	}
+	panic("internal error: unknown option " + name)
+}
+
+// Flag returns true if the flag was given
+func (c *Command) Flag(name string) bool {
+	return len(c.opt(name).vals) > 0
+}
+
+// String returns the value of the option or def if not given
+func (c *Command) String(name string, def string) string {
+	vals := c.opt(name).vals
+	if len(vals) == 0 {
+		return def
+	}
+	return vals[len(vals)-1]
+}
+
+// Int returns the value of the option or def if not given
+func (c *Command) Int(name string, def int) int {
+	vals := c.opt(name).vals
+	if len(vals) == 0 {
+		return def
+	}
+	i, _ := strconv.Atoi(vals[len(vals)-1]) // already checked by Parse
+	return i
+}
+
+// Strings returns all the values of a repeated option
+func (c *Command) Strings(name string) []string {
+	return c.opt(name).vals
+}
+
+// Usage returns the usage line, generated from the options and Args
+func (c *Command) Usage() string {
+	parts := []string{c.Name}
+	for _, o := range c.Opts {
+		str := o.name()
+		if o.Type != FlagOpt {
+			str += " <" + o.Arg + ">"
+		}
+		if o.Repeat {
+			str += "..."
+		}
+		parts = append(parts, "["+str+"]")
+	}
+	if c.Args != "" {
+		parts = append(parts, c.Args)
+	}
+	return strings.Join(parts, " ")
+}
+
+// OptsHelp returns the description of each option
+func (c *Command) OptsHelp() string {
+	if len(c.Opts) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteString("\noptions:\n")
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	for _, o := range c.Opts {
+		names := strings.Join(o.names(), ", ")
+		if o.Type != FlagOpt {
+			names += " <" + o.Arg + ">"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", names, o.Help)
+	}
+	fmt.Fprintf(tw, "  --\tend of the options, use before any argument starting with a '-'\n")
+	tw.Flush()
+	return buf.String()
+}
+
+func (c *Command) UsageErr() error {
+	return fmt.Errorf("%s %s\n", os.Args[0], c.Usage())
+}
+
+// Exec parses argv and runs the command
+func (c *Command) Exec(argv []string) error {
+	curCmd = c
+	showHelp, err := c.Parse(argv)
+	if err != nil {
+		return err
+	}
+	if showHelp {
+		fmt.Printf("Usage: %s %s\n", os.Args[0], c.Usage())
+		fmt.Printf("%s", c.OptsHelp())
+		fmt.Printf("%s\n", c.Help)
+		return nil
+	}
+	return c.Run()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	c := &Command{
+		Name: "test",
+		Opts: []*Opt{
+			{Short: "k", Long: "keep-going"},
+			{Short: "n", Long: "dry-run"},
+			{Short: "j", Long: "jobs", Type: IntOpt, Arg: "n"},
+			{Short: "x", Long: "exclude", Type: StringOpt, Arg: "pkg", Repeat: true},
+			fmtOpt("format"),
+		},
+	}
+	tests := []struct {
+		argv     []string
+		ok       bool
+		help     bool
+		flags    string // the flags given
+		jobs     int
+		format   string
+		exclude  []string
+		args     []string
+		dashArgs int
+	}{
+		{[]string{"a", "b"}, true, false, "", 1, "", nil, []string{"a", "b"}, -1},
+		{[]string{"-k", "a", "--dry-run"}, true, false, "kn", 1, "", nil, []string{"a"}, -1},
+		{[]string{"-kn"}, true, false, "kn", 1, "", nil, []string{}, -1},
+		{[]string{"-nkj", "4", "a"}, true, false, "kn", 4, "", nil, []string{"a"}, -1},
+		{[]string{"--jobs=3", "-f", "$name", "--", "-k"}, true, false, "", 3, "$name", nil, []string{"-k"}, 0},
+		{[]string{"--format=", "a"}, true, false, "", 1, "", nil, []string{"a"}, -1},
+		{[]string{"-kh"}, true, true, "k", 1, "", nil, []string{}, -1},
+		{[]string{"-"}, true, false, "", 1, "", nil, []string{"-"}, -1},
+		// attached values
+		{[]string{"-j4"}, true, false, "", 4, "", nil, []string{}, -1},
+		{[]string{"-kj4", "a"}, true, false, "k", 4, "", nil, []string{"a"}, -1},
+		{[]string{"-f$path"}, true, false, "", 1, "$path", nil, []string{}, -1},
+		{[]string{"-nf$name-k"}, true, false, "n", 1, "$name-k", nil, []string{}, -1},
+		// arguments starting with a '-'
+		{[]string{"set", "note", "--", "-x"}, true, false, "", 1, "", nil, []string{"set", "note", "-x"}, 2},
+		{[]string{"-5", "-k", "-1.5"}, true, false, "k", 1, "", nil, []string{"-5", "-1.5"}, -1},
+		{[]string{"-j", "-2"}, true, false, "", -2, "", nil, []string{}, -1},
+		// repeated
+		{[]string{"-x", "a", "-x", "b"}, true, false, "", 1, "", []string{"a", "b"}, []string{}, -1},
+		{[]string{"-xa", "--exclude=b", "c"}, true, false, "", 1, "", []string{"a", "b"}, []string{"c"}, -1},
+		// errors
+		{[]string{"-y"}, false, false, "", 0, "", nil, nil, 0},
+		{[]string{"-ky"}, false, false, "", 0, "", nil, nil, 0},
+		{[]string{"-jk", "4"}, false, false, "", 0, "", nil, nil, 0},
+		{[]string{"-j"}, false, false, "", 0, "", nil, nil, 0},
+		{[]string{"-kj"}, false, false, "", 0, "", nil, nil, 0},
+		{[]string{"-j", "x"}, false, false, "", 0, "", nil, nil, 0},
+		{[]string{"-k", "-k"}, false, false, "", 0, "", nil, nil, 0},
+		{[]string{"-kk"}, false, false, "", 0, "", nil, nil, 0},
+		{[]string{"-j1", "-j2"}, false, false, "", 0, "", nil, nil, 0},
+		{[]string{"--keep-going=yes"}, false, false, "", 0, "", nil, nil, 0},
+	}
+	for _, test := range tests {
+		help, err := c.Parse(test.argv)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%q: expected error", test.argv)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.argv, err)
+			continue
+		}
+		flags := ""
+		for _, f := range []string{"k", "n"} {
+			if c.Flag(f) {
+				flags += f
+			}
+		}
+		if help != test.help || flags != test.flags || c.Int("jobs", 1) != test.jobs ||
+			c.String("format", "") != test.format || !reflect.DeepEqual(c.Strings("exclude"), test.exclude) ||
+			!reflect.DeepEqual(args, test.args) || dashArgs != test.dashArgs {
+			t.Errorf("%q: got help=%v flags=%q jobs=%d format=%q exclude=%q args=%q dashArgs=%d", test.argv,
+				help, flags, c.Int("jobs", 1), c.String("format", ""), c.Strings("exclude"), args, dashArgs)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	c := &Command{
+		Name: "test",
+		Opts: []*Opt{
+			{Short: "k", Long: "keep-going"},
+			{Short: "x", Type: StringOpt, Arg: "pkg", Repeat: true},
+		},
+		Args: "<arg>",
+	}
+	expected := "test [-k|--keep-going] [-x <pkg>...] <arg>"
+	if usage := c.Usage(); usage != expected {
+		t.Errorf("got %q, expected %q", usage, expected)
+	}
+}
@@ -5,13 +5,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"sort"
 )
 
 type PackageFile struct {
 	GxDependencies []PackageDep
 	Name           string
+	Version        string
 	Gx             PackageGx
+	Dir            string `json:"-"` // only set if not in the standard location
 }
 
 type PackageDep struct {
@@ -23,10 +27,6 @@ type PackageGx struct {
 	Dvcsimport string
 }
 
-func GxDir(hash Hash, name string) string {
-	return filepath.Join(GXROOT, string(hash), name)
-}
-
 func ReadPackage(dir string) (*PackageFile, error) {
 	bytes, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
 	if err != nil {
@@ -45,15 +45,26 @@ type LastPubVer struct {
 	Hash    Hash
 }
 
+// NoLastPubVer is returned by ReadLastPubVer when the package was
+// never published
+var NoLastPubVer = fmt.Errorf("no .gx/lastpubver, never published")
+
+// BadLastPubVer is returned by ReadLastPubVer when the lastpubver can
+// not be parsed, which may be because it is still being written
+var BadLastPubVer = fmt.Errorf("bad lastpubver string")
+
 func ReadLastPubVer(dir string) (*LastPubVer, error) {
 	str, err := ioutil.ReadFile(filepath.Join(dir, ".gx", "lastpubver"))
+	if os.IsNotExist(err) {
+		return nil, NoLastPubVer
+	}
 	if err != nil {
 		return nil, err
 	}
 	str = bytes.TrimSpace(str)
 	i := bytes.IndexByte(str, ':')
-	if i == -1 || len(str) < i+1 || str[i+1] != ' ' {
-		return nil, fmt.Errorf("bad lastpubver string")
+	if i <= 0 || len(str) < i+2 || str[i+1] != ' ' {
+		return nil, BadLastPubVer
 	}
 	return &LastPubVer{
 		Version: string(str[:i]),
@@ -61,11 +72,158 @@ func ReadLastPubVer(dir string) (*LastPubVer, error) {
 	}, nil
 }
 
-func GetGxInfo() (pkg *PackageFile, lastPubVer *LastPubVer, err error) {
-	pkg, err = ReadPackage(".")
+// IsNotPublished returns true if err, from ReadLastPubVer, is because
+// the package was never published rather than a problem reading it.
+// A missing package.json is a problem.
+func IsNotPublished(err error) bool {
+	return err == NoLastPubVer || err == NoVersionTag
+}
+
+// GetPubInfo returns the package information and the last published
+// version of the package in dir
+func GetPubInfo(src PackageSource, dir string) (pkg *PackageFile, lastPubVer *LastPubVer, err error) {
+	pkg, err = src.ReadPackage(dir)
 	if err != nil {
 		return
 	}
-	lastPubVer, err = ReadLastPubVer(".")
+	lastPubVer, err = src.ReadLastPubVer(dir)
 	return
 }
+
+// DepEntry is an entry in the gxDependencies of a package.json along
+// with the location of its values so that they can be changed in
+// place
+type DepEntry struct {
+	Name    string
+	Hash    Hash
+	Version string
+
+	origHash    Hash
+	origVersion string
+	hashPos     [2]int
+	versionPos  [2]int // zero if there is no version
+}
+
+// ParseDepEntries finds the gxDependencies entries in the raw contents
+// of a package.json
+func ParseDepEntries(data []byte) ([]*DepEntry, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	expect := func(delim json.Delim) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok != delim {
+			return fmt.Errorf("package.json: expected '%s'", delim)
+		}
+		return nil
+	}
+	// str reads a string value and returns its location
+	str := func() (val string, pos [2]int, err error) {
+		start := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		val, ok := tok.(string)
+		if !ok {
+			err = fmt.Errorf("package.json: expected a string")
+			return
+		}
+		end := int(dec.InputOffset())
+		pos = [2]int{start + bytes.IndexByte(data[start:end], '"'), end}
+		return
+	}
+	skip := func() error {
+		var raw json.RawMessage
+		return dec.Decode(&raw)
+	}
+	entries := []*DepEntry{}
+	err := expect('{')
+	if err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key != "gxDependencies" {
+			if err := skip(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := expect('['); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			if err := expect('{'); err != nil {
+				return nil, err
+			}
+			entry := &DepEntry{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				switch key {
+				case "name":
+					entry.Name, _, err = str()
+				case "hash":
+					var hash string
+					hash, entry.hashPos, err = str()
+					entry.Hash = Hash(hash)
+				case "version":
+					entry.Version, entry.versionPos, err = str()
+				default:
+					err = skip()
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			if err := expect('}'); err != nil {
+				return nil, err
+			}
+			entry.origHash = entry.Hash
+			entry.origVersion = entry.Version
+			entries = append(entries, entry)
+		}
+		if err := expect(']'); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// SetDepEntries returns a copy of data with the values of the entries
+// that were changed replaced, everything else is kept as is
+func SetDepEntries(data []byte, entries []*DepEntry) ([]byte, error) {
+	type edit struct {
+		pos [2]int
+		val string
+	}
+	edits := []edit{}
+	for _, entry := range entries {
+		if entry.Hash != entry.origHash {
+			if entry.hashPos[1] == 0 {
+				return nil, fmt.Errorf("package.json: no hash for %s", entry.Name)
+			}
+			edits = append(edits, edit{entry.hashPos, string(entry.Hash)})
+		}
+		if entry.Version != entry.origVersion && entry.versionPos[1] != 0 {
+			edits = append(edits, edit{entry.versionPos, entry.Version})
+		}
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].pos[0] > edits[j].pos[0] })
+	res := append([]byte{}, data...)
+	for _, e := range edits {
+		val, err := json.Marshal(e.val)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res[:e.pos[0]], append(val, res[e.pos[1]:]...)...)
+	}
+	return res, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPackageJson = `{
+  "author": "joeuser",
+  "gx": {
+    "dvcsimport": "github.com/ipfs/go-foo"
+  },
+  "gxDependencies": [
+    {
+      "author": "whyrusleeping",
+      "hash": "QmA",
+      "name": "go-a",
+      "version": "1.0.0"
+    },
+    {"hash":"QmB","name":"go-b"},
+    {
+      "name": "go-c",
+      "version": "0.2.1",
+      "hash": "QmC"
+    }
+  ],
+  "name": "go-foo",
+  "version": "0.1.0"
+}
+`
+
+func TestParseDepEntries(t *testing.T) {
+	entries, err := ParseDepEntries([]byte(testPackageJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DepEntry{
+		{Name: "go-a", Hash: "QmA", Version: "1.0.0"},
+		{Name: "go-b", Hash: "QmB"},
+		{Name: "go-c", Hash: "QmC", Version: "0.2.1"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("got %d entries, expected %d", len(entries), len(expected))
+	}
+	for i, entry := range entries {
+		exp := expected[i]
+		if entry.Name != exp.Name || entry.Hash != exp.Hash || entry.Version != exp.Version {
+			t.Errorf("entry %d: got %+v, expected %+v", i, *entry, exp)
+		}
+		data := []byte(testPackageJson)
+		if got := string(data[entry.hashPos[0]:entry.hashPos[1]]); got != `"`+string(exp.Hash)+`"` {
+			t.Errorf("entry %d: hash position points to %s", i, got)
+		}
+	}
+}
+
+func TestParseDepEntriesErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`[]`,
+		`{"gxDependencies": {}}`,
+		`{"gxDependencies": [{"hash": 1}]}`,
+		`{"gxDependencies": [{"hash": "QmA"}`,
+	}
+	for _, str := range tests {
+		if _, err := ParseDepEntries([]byte(str)); err == nil {
+			t.Errorf("expected error for %q", str)
+		}
+	}
+}
+
+func TestSetDepEntries(t *testing.T) {
+	entries, err := ParseDepEntries([]byte(testPackageJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries[0].Hash = "QmA2"
+	entries[0].Version = "1.0.1"
+	entries[1].Hash = "QmB2"
+	entries[1].Version = "2.0.0" // no version in the original so not added
+	entries[2].Version = "0.2.2"
+	res, err := SetDepEntries([]byte(testPackageJson), entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{
+  "author": "joeuser",
+  "gx": {
+    "dvcsimport": "github.com/ipfs/go-foo"
+  },
+  "gxDependencies": [
+    {
+      "author": "whyrusleeping",
+      "hash": "QmA2",
+      "name": "go-a",
+      "version": "1.0.1"
+    },
+    {"hash":"QmB2","name":"go-b"},
+    {
+      "name": "go-c",
+      "version": "0.2.2",
+      "hash": "QmC"
+    }
+  ],
+  "name": "go-foo",
+  "version": "0.1.0"
+}
+`
+	if string(res) != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", res, expected)
+	}
+
+	// nothing changed
+	entries, _ = ParseDepEntries([]byte(testPackageJson))
+	res, err = SetDepEntries([]byte(testPackageJson), entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != testPackageJson {
+		t.Errorf("unchanged entries modified package.json:\n%s", res)
+	}
+
+	// a hash can not be added
+	entries = []*DepEntry{{Name: "go-d", Hash: "QmD"}}
+	if _, err := SetDepEntries([]byte(testPackageJson), entries); err == nil {
+		t.Errorf("expected error when setting a hash that is not there")
+	}
+}
+
+func TestReadLastPubVer(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ReadLastPubVer(dir); err != NoLastPubVer {
+		t.Errorf("missing: got %v, expected NoLastPubVer", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, ".gx"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		str string
+		exp *LastPubVer // nil if an error is expected
+	}{
+		{"1.0.1: QmA\n", &LastPubVer{"1.0.1", "QmA"}},
+		{"", nil},
+		{"1.0.1", nil},
+		// partly written
+		{"1.0.1:", nil},
+		{"1.0.1: ", nil},
+		// no version
+		{": QmA", nil},
+		{"1.0.1:QmA", nil},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(filepath.Join(dir, ".gx", "lastpubver"), []byte(test.str), 0644); err != nil {
+			t.Fatal(err)
+		}
+		lastPubVer, err := ReadLastPubVer(dir)
+		switch {
+		case test.exp == nil && err == nil:
+			t.Errorf("%q: expected error, got %+v", test.str, lastPubVer)
+		case test.exp != nil && err != nil:
+			t.Errorf("%q: %s", test.str, err)
+		case test.exp != nil && *lastPubVer != *test.exp:
+			t.Errorf("%q: got %+v, expected %+v", test.str, lastPubVer, test.exp)
+		}
+		if IsNotPublished(err) {
+			t.Errorf("%q: bad lastpubver taken as never published", test.str)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// PackageSource provides the package metadata needed to gather the
+// deps. and to track what has been published.
+type PackageSource interface {
+	// Package resolves a hash to its package metadata, name is the
+	// name the package is known by.  The empty hash is the root
+	// package.
+	Package(hash Hash, name string) (*PackageFile, error)
+	// ReadPackage returns the package metadata of the checked out
+	// package in dir
+	ReadPackage(dir string) (*PackageFile, error)
+	// ReadLastPubVer returns the last published version of the
+	// checked out package in dir.  If it was never published the
+	// error is NoLastPubVer, or NoVersionTag for go modules.
+	ReadLastPubVer(dir string) (*LastPubVer, error)
+}
+
+// NewSource returns the filesystem based source for backend with
+// root as the directory of the root package
+func NewSource(backend string, root string) PackageSource {
+	if backend == ModBackend {
+		return NewModSource(root)
+	}
+	return NewCacheSource(&FsSource{Root: root, GxRoot: GXROOT})
+}
+
+// FsSource reads gx packages from the filesystem, dependencies are
+// expected to be in GxRoot.
+type FsSource struct {
+	Root   string
+	GxRoot string
+}
+
+func (src *FsSource) Package(hash Hash, name string) (*PackageFile, error) {
+	if hash == "" {
+		return ReadPackage(src.Root)
+	}
+	return ReadPackage(filepath.Join(src.GxRoot, string(hash), name))
+}
+
+func (src *FsSource) ReadPackage(dir string) (*PackageFile, error) {
+	return ReadPackage(dir)
+}
+
+func (src *FsSource) ReadLastPubVer(dir string) (*LastPubVer, error) {
+	return ReadLastPubVer(dir)
+}
+
+// MemSource is an in-memory source mainly useful for testing and for
+// embedding in other tools.
+type MemSource struct {
+	Packages    map[Hash]*PackageFile   // by hash, "" is the root package
+	Dirs        map[string]*PackageFile // checked out packages by dir
+	LastPubVers map[string]*LastPubVer  // by dir
+}
+
+func (src *MemSource) Package(hash Hash, name string) (*PackageFile, error) {
+	pkg, ok := src.Packages[hash]
+	if !ok {
+		return nil, fmt.Errorf("package not found: %s %s", hash, name)
+	}
+	return pkg, nil
+}
+
+func (src *MemSource) ReadPackage(dir string) (*PackageFile, error) {
+	pkg, ok := src.Dirs[dir]
+	if !ok {
+		return nil, fmt.Errorf("no package in %s", dir)
+	}
+	return pkg, nil
+}
+
+func (src *MemSource) ReadLastPubVer(dir string) (*LastPubVer, error) {
+	lastPubVer, ok := src.LastPubVers[dir]
+	if !ok {
+		return nil, NoLastPubVer
+	}
+	return lastPubVer, nil
+}
+
+// PrefetchSource is a source that has already read a package and all
+// its deps., see Prefetch.
+type PrefetchSource struct {
+	PackageSource
+	mu      sync.Mutex
+	pkgs    map[Hash]*prefetched
+	workers chan struct{}
+	wg      sync.WaitGroup
+}
+
+type prefetched struct {
+	pkg *PackageFile
+	err error
+}
+
+// Prefetch reads the package root and all of its deps. from src using
+// up to workers goroutines at once.  Each hash is only read once.
+// Errors are remembered and returned when the package is asked for.
+func Prefetch(src PackageSource, root Hash, name string, workers int) *PrefetchSource {
+	p := &PrefetchSource{
+		PackageSource: src,
+		pkgs:          map[Hash]*prefetched{},
+		workers:       make(chan struct{}, workers),
+	}
+	p.fetch(root, name)
+	p.wg.Wait()
+	return p
+}
+
+// fetch reads hash and then its deps. in a new goroutine.  A worker
+// slot is taken before the goroutine is started, so that the packages
+// waiting to be read don't each have an idle goroutine, and released
+// before the deps. are fetched so that a goroutine never waits for a
+// slot while holding one.
+func (p *PrefetchSource) fetch(hash Hash, name string) {
+	p.mu.Lock()
+	if p.pkgs[hash] != nil {
+		p.mu.Unlock()
+		return
+	}
+	res := &prefetched{}
+	p.pkgs[hash] = res
+	p.mu.Unlock()
+	p.wg.Add(1)
+	p.workers <- struct{}{}
+	go func() {
+		defer p.wg.Done()
+		pkg, err := p.PackageSource.Package(hash, name)
+		<-p.workers
+		p.mu.Lock()
+		res.pkg, res.err = pkg, err
+		p.mu.Unlock()
+		if err != nil {
+			return
+		}
+		for _, dep := range pkg.GxDependencies {
+			p.fetch(dep.Hash, dep.Name)
+		}
+	}()
+}
+
+func (p *PrefetchSource) Package(hash Hash, name string) (*PackageFile, error) {
+	p.mu.Lock()
+	res := p.pkgs[hash]
+	p.mu.Unlock()
+	if res == nil {
+		return p.PackageSource.Package(hash, name)
+	}
+	return res.pkg, res.err
+}
@@ -9,23 +9,30 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 )
 
 type JsonState struct {
+	Version  int
+	Backend  string `json:",omitempty"` // empty for gx
 	Todo     []*Todo
 	Defaults map[string]string `json:",omitempty"`
 }
 
 type Todo struct {
-	Name       string
-	Path       string
-	Level      int
-	OrigHash   Hash     `json:",omitempty"`
-	Deps       []string `json:",omitempty"`
-	AlsoUpdate []string `json:",omitempty"`
-	Indirect   []string `json:",omitempty"`
+	Name        string
+	Id          string `json:",omitempty"` // only set if different from Name
+	Path        string
+	Dir         string `json:",omitempty"`
+	Level       int
+	OrigHash    Hash     `json:",omitempty"`
+	OrigVersion string   `json:",omitempty"` // empty if unknown, see NewRelease
+	Deps        []string `json:",omitempty"`
+	AlsoUpdate  []string `json:",omitempty"`
+	Indirect    []string `json:",omitempty"`
+	Targets     []string `json:",omitempty"`
 
 	UnmetDeps []string `json:",omitempty"`
 
@@ -35,6 +42,7 @@ type Todo struct {
 
 	Meta     map[string]string `json:",omitempty"`
 	defaults map[string]string // shared among all todo entries
+	backend  string            // shared among all todo entries
 
 	Published bool // published and in a valid state
 	Ready     bool // all name deps published
@@ -43,7 +51,7 @@ type Todo struct {
 }
 
 type TodoList []*Todo
-type TodoByName map[string]*Todo
+type TodoByName map[string]*Todo // by id
 
 func (x *Todo) Less(y *Todo) bool {
 	if x.Level != y.Level {
@@ -57,7 +65,19 @@ func (x *Todo) Less(y *Todo) bool {
 			return x.Deps[i] < y.Deps[i]
 		}
 	}
-	return x.Name < y.Name
+	if x.Name != y.Name {
+		return x.Name < y.Name
+	}
+	return x.OrigHash < y.OrigHash
+}
+
+// Key returns the id used to refer to the entry, this is just the name
+// unless there is more than one version of the package
+func (v *Todo) Key() string {
+	if v.Id != "" {
+		return v.Id
+	}
+	return v.Name
 }
 
 type NotYetPublished struct {
@@ -74,14 +94,18 @@ type KeyDesc struct {
 	Alias  string
 	Desc   string
 	Unused bool
+	List   bool // a list of entries that can be used with ${each ...}
 }
 
 var BasicKeys = []KeyDesc{
 	{Name: "name", Desc: "package name"},
+	{Name: "id", Desc: "package name, or <name>@<orighash> if there is more than one version"},
+	{Name: "orighash", Desc: "hash of the package before the update"},
 	{Name: "path", Desc: "import path"},
-	{Name: "dir", Desc: "directory package is located in"},
-	{Name: "giturl", Desc: "git url for downloading packages"},
-	{Name: "deps", Desc: "space sperated list of direct deps."},
+	{Name: "dir", Desc: "directory package is located in, undefined for go modules without a local replace"},
+	{Name: "giturl", Desc: "git url for downloading packages, undefined if the path has no host"},
+	{Name: "deps", Desc: "space sperated list of direct deps.", List: true},
+	{Name: "targets", Desc: "space seperated list of targets that caused the dep. to be included"},
 }
 
 var AllKeys = append(BasicKeys, []KeyDesc{
@@ -90,10 +114,18 @@ var AllKeys = append(BasicKeys, []KeyDesc{
 	{Name: "invalidated", Desc: "the string INVALIDATED if invalidated"},
 	{Name: "ver", Desc: "current version if published", Alias: "version"},
 	{Name: "hash", Desc: "current hash if published"},
-	{Name: "unmet", Desc: "space seperated list of unmet deps.", Alias: "unmetdeps"},
-	{Name: "level", Unused: true},
+	{Name: "unmet", Desc: "space seperated list of unmet deps.", Alias: "unmetdeps", List: true},
+	{Name: "level", Desc: "level in the reverse dep. graph, 0 for the targets"},
 }...)
 
+// EachKeys are lists that can only be used with ${each ...}.  They are
+// not variables so that, unlike AllKeys, they can still be used as
+// meta keys.
+var EachKeys = []KeyDesc{
+	{Name: "also", Desc: "the indirect deps. also listed in package.json", List: true},
+	{Name: "indirect", Desc: "the other indirect deps.", List: true},
+}
+
 func KeysHelp(keys []KeyDesc) string {
 	var buf bytes.Buffer
 	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
@@ -116,18 +148,23 @@ func (v *Todo) Get(key string) (val string, have bool, err error) {
 	case "name":
 		val = v.Name
 		have = true
+	case "id":
+		val = v.Key()
+		have = true
+	case "orighash":
+		val = string(v.OrigHash)
+		have = v.OrigHash != ""
 	case "path":
 		val = v.Path
 		have = true
 	case "dir":
-		dirs := []string{GOPATH, "src"}
-		dirs = append(dirs, strings.Split(v.Path, "/")...)
-		val = filepath.Join(dirs...)
-		have = true
+		val, have = v.LocalDir()
 	case "giturl":
 		i := strings.IndexByte(v.Path, '/')
 		if i == -1 {
-			panic("ill formed path")
+			// valid for go modules, e.g. 'module myroot'
+			err = fmt.Errorf("%s: '%s' undefined, path has no host", v.Path, key)
+			return
 		}
 		val = fmt.Sprintf("git@%s:%s.git", v.Path[:i], v.Path[i+1:])
 		have = true
@@ -160,6 +197,9 @@ func (v *Todo) Get(key string) (val string, have bool, err error) {
 	case "deps":
 		val = strings.Join(v.Deps, " ")
 		have = len(v.Deps) > 0
+	case "targets":
+		val = strings.Join(v.Targets, " ")
+		have = len(v.Targets) > 0
 	case "unmet", "unmetdeps":
 		val = strings.Join(v.UnmetDeps, " ")
 		have = len(v.UnmetDeps) > 0
@@ -168,6 +208,9 @@ func (v *Todo) Get(key string) (val string, have bool, err error) {
 			val = "INVALIDATED"
 			have = true
 		}
+	case "level":
+		val = strconv.Itoa(v.Level)
+		have = true
 	default:
 		val, have = v.Meta[key]
 		if have {
@@ -183,6 +226,47 @@ func (v *Todo) Get(key string) (val string, have bool, err error) {
 	return
 }
 
+// List returns the entries of a list, such as "deps", for use with
+// ${each ...}
+func (v *Todo) List(key string) ([]Getter, bool) {
+	var ids []string
+	switch key {
+	case "deps":
+		ids = v.Deps
+	case "also":
+		ids = v.AlsoUpdate
+	case "indirect":
+		ids = v.Indirect
+	case "unmet", "unmetdeps":
+		ids = v.UnmetDeps
+	default:
+		return nil, false
+	}
+	res := []Getter{}
+	for _, id := range ids {
+		if todo := v.others[id]; todo != nil {
+			res = append(res, todo)
+		}
+	}
+	return res, true
+}
+
+// LocalDir returns the directory of the checked out package.  For
+// gx packages it is in GOPATH unless Dir is set.  Go modules are
+// only checked out if there is a replace with a local directory, the
+// module cache is read only, so false is returned otherwise.
+func (v *Todo) LocalDir() (string, bool) {
+	if v.Dir != "" {
+		return v.Dir, true
+	}
+	if v.backend == ModBackend {
+		return "", false
+	}
+	dirs := []string{GOPATH, "src"}
+	dirs = append(dirs, strings.Split(v.Path, "/")...)
+	return filepath.Join(dirs...), true
+}
+
 func CheckInternal(key string) error {
 	for _, kd := range AllKeys {
 		if key == kd.Name || key == kd.Alias {
@@ -208,35 +292,190 @@ func (v *Todo) Unset(key string) error {
 	return nil
 }
 
-func Gather(pkgName string) (pkgs Packages, todoList TodoList, err error) {
+func Gather(src PackageSource, pkgNames ...string) (pkgs Packages, todoList TodoList, err error) {
 	pkgs = Packages{}
-	_, err = GatherDeps(pkgs, "", ".")
+	_, err = GatherDeps(src, pkgs, "", "")
 	if err != nil {
 		err = fmt.Errorf("could not gather deps: %s", err.Error())
 		return
 	}
+	if len(pkgs.Cycles(pkgs.All())) > 0 {
+		pkgs.FixClosure()
+	}
 	//pkgs.Dump()
-	target := pkgs.ByName(pkgName)
-	if target == nil {
-		err = fmt.Errorf("package not found: %s", pkgName)
+	targets := []Hash{}
+	seen := DepSet{}
+	for _, pkgName := range pkgNames {
+		var found []*PkgInfo
+		found, err = pkgs.Select(pkgName)
+		if err != nil {
+			return
+		}
+		for _, target := range found {
+			if seen.Add(target.Hash) > 0 {
+				targets = append(targets, target.Hash)
+			}
+		}
+	}
+	lst, err := BubbleList(pkgs, targets...)
+	if err != nil {
 		return
 	}
-	lst := BubbleList(pkgs, target.Hash)
+	hashes := make([]Hash, len(lst))
+	for i, dep := range lst {
+		hashes[i] = dep.Hash
+	}
+	ids := pkgs.Ids(hashes)
 	for _, dep := range lst {
-		todoList = append(todoList, &Todo{
-			Name:       pkgs[dep.Hash].Name,
-			Path:       pkgs[dep.Hash].Path,
-			Level:      dep.Level,
-			OrigHash:   dep.Hash,
-			Deps:       pkgs.Names(dep.DirectDeps),
-			AlsoUpdate: pkgs.Names(dep.AlsoUpdate),
-			Indirect:   pkgs.Names(dep.IndirectDeps),
-		})
+		todo := &Todo{
+			Name:        pkgs[dep.Hash].Name,
+			Path:        pkgs[dep.Hash].Path,
+			Dir:         pkgs[dep.Hash].Dir,
+			Level:       dep.Level,
+			OrigHash:    dep.Hash,
+			OrigVersion: pkgs[dep.Hash].Version,
+			Deps:        Names(ids, dep.DirectDeps),
+			AlsoUpdate:  Names(ids, dep.AlsoUpdate),
+			Indirect:    Names(ids, dep.IndirectDeps),
+			Targets:     Names(ids, dep.Targets),
+		}
+		if ids[dep.Hash] != todo.Name {
+			todo.Id = ids[dep.Hash]
+		}
+		todoList = append(todoList, todo)
 	}
 	sort.Slice(todoList, func(i, j int) bool { return todoList[i].Less(todoList[j]) })
 	return
 }
 
+// Targets returns the names of the packages the session was started
+// for.  Older state files do not record the targets in which case the
+// entries at level 0 are used instead.
+func (todoList TodoList) Targets() []string {
+	targets := NameSet{}
+	for _, todo := range todoList {
+		targets.Add(todo.Targets...)
+	}
+	if len(targets) == 0 {
+		for _, todo := range todoList {
+			if todo.Level == 0 {
+				targets.Add(todo.Key())
+			}
+		}
+	}
+	res := make([]string, 0, len(targets))
+	for name, _ := range targets {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+type MergeSummary struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// Merge carries over the published state and meta-data from the
+// entries in old into the matching entries of todoList.  Entries
+// in old that are no longer part of todoList are dropped.
+func (todoList TodoList) Merge(old TodoList) (summary MergeSummary) {
+	// match up the entries by name and original hash, the id may have
+	// changed due to another version of the package being added or
+	// removed
+	prevOf := map[*Todo]*Todo{}
+	newIds := map[string]string{} // old id -> new id
+	match := func(todo, prev *Todo) {
+		prevOf[todo] = prev
+		newIds[prev.Key()] = todo.Key()
+	}
+	oldByHash := map[string]*Todo{}
+	for _, todo := range old {
+		oldByHash[todo.Name+"@"+string(todo.OrigHash)] = todo
+	}
+	for _, todo := range todoList {
+		if prev, ok := oldByHash[todo.Name+"@"+string(todo.OrigHash)]; ok {
+			match(todo, prev)
+		}
+	}
+	// otherwise, if the hash of a package changed, fall back to the
+	// name but only when there is just one unmatched entry with that
+	// name in both so that the published info is never moved to
+	// another version
+	oldByName := map[string]TodoList{}
+	for _, todo := range old {
+		if _, ok := newIds[todo.Key()]; !ok {
+			oldByName[todo.Name] = append(oldByName[todo.Name], todo)
+		}
+	}
+	newByName := map[string]TodoList{}
+	for _, todo := range todoList {
+		if _, ok := prevOf[todo]; !ok {
+			newByName[todo.Name] = append(newByName[todo.Name], todo)
+		}
+	}
+	for name, lst := range newByName {
+		if len(lst) == 1 && len(oldByName[name]) == 1 {
+			match(lst[0], oldByName[name][0])
+		}
+	}
+	// the old deps. using the new ids so that a dep. whose id changed
+	// does not count as a change
+	newDeps := func(deps []string) []string {
+		res := make([]string, len(deps))
+		for i, id := range deps {
+			if newId, ok := newIds[id]; ok {
+				id = newId
+			}
+			res[i] = id
+		}
+		sort.Strings(res)
+		return res
+	}
+	for _, todo := range todoList {
+		prev, ok := prevOf[todo]
+		if !ok {
+			summary.Added = append(summary.Added, todo.Key())
+			continue
+		}
+		if prev.Path != todo.Path || prev.Level != todo.Level || prev.OrigHash != todo.OrigHash ||
+			!equalStrings(newDeps(prev.Deps), todo.Deps) || !equalStrings(newDeps(prev.AlsoUpdate), todo.AlsoUpdate) ||
+			!equalStrings(newDeps(prev.Indirect), todo.Indirect) {
+			summary.Changed = append(summary.Changed, todo.Key())
+		}
+		todo.NewHash = prev.NewHash
+		todo.NewVersion = prev.NewVersion
+		if prev.NewDeps != nil {
+			todo.NewDeps = map[string]Hash{}
+			for id, hash := range prev.NewDeps {
+				if newId, ok := newIds[id]; ok {
+					todo.NewDeps[newId] = hash
+				}
+			}
+		}
+		todo.Meta = prev.Meta
+	}
+	for _, todo := range old {
+		if _, ok := newIds[todo.Key()]; !ok {
+			summary.Removed = append(summary.Removed, todo.Key())
+		}
+	}
+	return
+}
+
+func equalStrings(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func ReadStateFile() (state JsonState, err error) {
 	fn := os.Getenv("GX_UPDATE_STATE")
 	if fn == "" {
@@ -247,7 +486,10 @@ func ReadStateFile() (state JsonState, err error) {
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(bytes, &state)
+	state, err = DecodeState(bytes)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", fn, err.Error())
+	}
 	return
 }
 
@@ -258,34 +500,221 @@ func Encode(out io.Writer, v interface{}) error {
 }
 
 // Write writes the contents back to disk, file must already exist as
-// a safety mechanism
-func (todoList TodoList) Write() error {
+// a safety mechanism.  The previous state is saved in the journal so
+// the change, described by desc, can be undone and events are
+// appended to the history log.
+func (todoList TodoList) Write(desc string, events ...LogEntry) error {
 	fn := os.Getenv("GX_UPDATE_STATE")
 	if fn == "" {
 		return fmt.Errorf("GX_UPDATE_STATE not set")
 	}
-	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_TRUNC, 0666)
+	err := LockState(fn)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	prev, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	state := JsonState{Version: StateVersion, Todo: todoList, Defaults: todoList[0].defaults}
+	if todoList[0].backend != GxBackend {
+		state.Backend = todoList[0].backend
+	}
+	err = WriteStateFile(fn, state, fi.Mode().Perm(), true)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	state := JsonState{Todo: todoList, Defaults: todoList[0].defaults}
-	return Encode(f, state)
+	err = RecordChange(fn, desc, prev)
+	if err != nil {
+		return err
+	}
+	return AppendLog(fn, events...)
+}
+
+// WriteStateFile atomically writes the state to fn by first writing
+// to a temporary file in the same directory and then renaming it.
+// If replace is false fn must not already exist.
+func WriteStateFile(fn string, state JsonState, perm os.FileMode, replace bool) error {
+	var buf bytes.Buffer
+	err := Encode(&buf, state)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(fn, buf.Bytes(), perm, replace)
+}
+
+func WriteFileAtomic(fn string, data []byte, perm os.FileMode, replace bool) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if replace {
+		return os.Rename(tmp, fn)
+	}
+	// a hard link, unlike rename, fails if fn already exists
+	err = os.Link(tmp, fn)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists", fn)
+	}
+	return err
 }
 
 func (todoList TodoList) CreateMap() (TodoByName, error) {
 	byName := TodoByName{}
 	for _, v := range todoList {
-		prev, ok := byName[v.Name]
+		prev, ok := byName[v.Key()]
 		if ok {
-			// FIXME: Maybe be a little more permissive...
-			return nil, fmt.Errorf("duplicate entries for %s: %s and %s", v.Name, prev.OrigHash, prev.OrigHash)
+			return nil, fmt.Errorf("duplicate entries for %s: %s and %s", v.Key(), prev.OrigHash, v.OrigHash)
 		}
-		byName[v.Name] = v
+		byName[v.Key()] = v
 	}
 	return byName, nil
 }
 
+// Find finds the entry matching sel, which is either an id, a name if
+// there is only one version of the package, or <name>@<hash> where
+// <hash> can be a prefix of the original hash, or for go modules the
+// version or its leading components, see Select.
+func (byName TodoByName) Find(sel string) (*Todo, error) {
+	if todo, ok := byName[sel]; ok {
+		return todo, nil
+	}
+	name, hash := sel, ""
+	if i := strings.IndexByte(sel, '@'); i != -1 {
+		name, hash = sel[:i], sel[i+1:]
+	}
+	found := TodoList{}
+	for _, todo := range byName {
+		if todo.Name == name && sameHash(todo.OrigHash, hash) {
+			return todo, nil
+		}
+		if todo.Name == name && hashHasPrefix(todo.OrigHash, hash) {
+			found = append(found, todo)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("could not find entry for %s", sel)
+	case 1:
+		return found[0], nil
+	}
+	ids := make([]string, len(found))
+	for i, todo := range found {
+		ids[i] = todo.Key()
+	}
+	sort.Strings(ids)
+	return nil, fmt.Errorf("multiple entries for %s, use -p to select one of: %s", sel, strings.Join(ids, " "))
+}
+
+// FindCurrent finds the entry for the package in the current
+// directory, which is named name.  If sel is not empty it is used
+// to select the version of the package as done by Find.
+func (byName TodoByName) FindCurrent(name string, sel string) (*Todo, error) {
+	if sel == "" {
+		sel = name
+	} else if selName := strings.SplitN(sel, "@", 2)[0]; selName != name {
+		return nil, fmt.Errorf("current package is %s not %s", name, selName)
+	}
+	return byName.Find(sel)
+}
+
+// DepId returns the id of the dep. of v with the given name
+func (v *Todo) DepId(name string) (string, bool) {
+	for _, lst := range [][]string{v.Deps, v.AlsoUpdate, v.Indirect} {
+		for _, id := range lst {
+			if dep := v.others[id]; dep != nil && dep.Name == name {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Mark marks v as published with the given hash and version, the
+// hashes of the deps. in the session are taken from pkg
+func (v *Todo) Mark(pkg *PackageFile, lastPubVer *LastPubVer) {
+	v.NewHash = lastPubVer.Hash
+	v.NewVersion = lastPubVer.Version
+	depMap := map[string]Hash{}
+	for _, dep := range pkg.GxDependencies {
+		if id, ok := v.DepId(dep.Name); ok {
+			depMap[id] = dep.Hash
+		}
+	}
+	v.NewDeps = depMap
+}
+
+// NewRelease returns true if lastPubVer is a release made since the
+// session was started, that is its version is higher than the
+// original version.  If the original version is unknown, as it is for
+// older state files, any hash other than the original is taken as a
+// new release.
+func (v *Todo) NewRelease(lastPubVer *LastPubVer) bool {
+	if lastPubVer.Hash == v.OrigHash {
+		return false
+	}
+	orig := v.OrigVersion
+	if orig == "" && v.backend == ModBackend {
+		_, orig = SplitModHash(v.OrigHash)
+	}
+	if orig == "" {
+		return true
+	}
+	return CompareVersions(lastPubVer.Version, orig) > 0
+}
+
+// ScanPublished visits the directory of each entry, other than the
+// root, and marks the ones with a new release, see NewRelease, that is
+// not already marked.  A "published" log entry is returned for each.
+// Packages that were never published are skipped, any other problem
+// is returned in errs and the other packages are still visited.
+func (lst TodoList) ScanPublished(src PackageSource) (events []LogEntry, errs []error) {
+	events = []LogEntry{}
+	for _, todo := range lst {
+		dir, ok := todo.LocalDir()
+		if todo.OrigHash == "" || !ok {
+			continue
+		}
+		pkg, lastPubVer, err := GetPubInfo(src, dir)
+		if IsNotPublished(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", todo.Key(), err.Error()))
+			continue
+		}
+		if lastPubVer.Hash == todo.NewHash || !todo.NewRelease(lastPubVer) {
+			continue
+		}
+		oldInfo := todo.PubInfo()
+		todo.Mark(pkg, lastPubVer)
+		events = append(events, LogEntry{Event: "published", Package: todo.Key(), Old: oldInfo, New: todo.PubInfo()})
+	}
+	return
+}
+
+// GetTodo reads the state file for commands that don't change it.
+// The state is not locked as the file is always replaced atomically,
+// use GetTodoLocked if the state may be written back.
 func GetTodo() (lst TodoList, byName TodoByName, err error) {
 	state, err := ReadStateFile()
 	if err != nil {
@@ -296,22 +725,91 @@ func GetTodo() (lst TodoList, byName TodoByName, err error) {
 	if defaults == nil {
 		defaults = map[string]string{}
 	}
+	backend := state.Backend
+	if backend == "" {
+		backend = GxBackend
+	}
 	byName, err = lst.CreateMap()
 	if err != nil {
 		return
 	}
 	for _, todo := range lst {
 		todo.defaults = defaults
+		todo.backend = backend
 		todo.others = byName
 	}
 	return
 }
 
-func UpdateState(lst TodoList, byName TodoByName) {
+// GetTodoLocked locks the state and then reads it so that the caller
+// can write it back without losing the changes of another
+// invocation.  The state remains locked until UnlockState is called
+// or the process exits.
+func GetTodoLocked() (lst TodoList, byName TodoByName, err error) {
+	fn := os.Getenv("GX_UPDATE_STATE")
+	if fn == "" {
+		err = fmt.Errorf("GX_UPDATE_STATE not set")
+		return
+	}
+	err = LockState(fn)
+	if err != nil {
+		return
+	}
+	return GetTodo()
+}
+
+// Unblocks returns the number of entries that will become ready once
+// v is published
+func (v *Todo) Unblocks(lst TodoList) int {
+	count := 0
 	for _, todo := range lst {
-		if todo.NewHash != "" {
-			todo.Published = true
+		if !todo.Published && len(todo.UnmetDeps) == 1 && todo.UnmetDeps[0] == v.Key() {
+			count++
 		}
+	}
+	return count
+}
+
+// Next returns the ready entry that unblocks the most other entries,
+// ties are broken using Less.  Nil is returned if nothing is ready.
+// Entries without a local checkout are skipped.
+func (lst TodoList) Next() *Todo {
+	var best *Todo
+	bestCount := 0
+	for _, todo := range lst {
+		if _, ok := todo.LocalDir(); !todo.Ready || !ok {
+			continue
+		}
+		count := todo.Unblocks(lst)
+		if best == nil || count > bestCount || count == bestCount && todo.Less(best) {
+			best = todo
+			bestCount = count
+		}
+	}
+	return best
+}
+
+// UpdateStateEvents calls UpdateState and returns an "invalidated" log
+// entry for each entry that is no longer published
+func UpdateStateEvents(lst TodoList, byName TodoByName) []LogEntry {
+	wasPublished := map[*Todo]bool{}
+	for _, todo := range lst {
+		wasPublished[todo] = todo.Published
+	}
+	UpdateState(lst, byName)
+	events := []LogEntry{}
+	for _, todo := range lst {
+		if wasPublished[todo] && !todo.Published && todo.NewHash != "" {
+			events = append(events, LogEntry{Event: "invalidated", Package: todo.Key(), Old: todo.PubInfo()})
+		}
+	}
+	return events
+}
+
+func UpdateState(lst TodoList, byName TodoByName) {
+	for _, todo := range lst {
+		// recomputed as the hash may have been reset
+		todo.Published = todo.NewHash != ""
 		for name, hash := range todo.NewDeps {
 			if !byName[name].Published || byName[name].NewHash != hash {
 				todo.Published = false
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testSource returns a MemSource for the dep. graph given as a map
+// from package name to the names of its direct deps.  The hash of a
+// package is "Qm" followed by its name, and the path
+// "example.com/<name>", except for "root" which is the root package.
+func testSource(graph map[string][]string) *MemSource {
+	hash := func(name string) Hash {
+		if name == "root" {
+			return ""
+		}
+		return Hash("Qm" + name)
+	}
+	src := &MemSource{Packages: map[Hash]*PackageFile{}}
+	for name, deps := range graph {
+		pkg := &PackageFile{Name: name, Gx: PackageGx{Dvcsimport: "example.com/" + name}}
+		for _, dep := range deps {
+			pkg.GxDependencies = append(pkg.GxDependencies, PackageDep{Hash: hash(dep), Name: dep})
+		}
+		src.Packages[hash(name)] = pkg
+	}
+	return src
+}
+
+// diamond is root -> A, B -> C with A also depending on D
+var diamond = map[string][]string{
+	"root": {"A", "B"},
+	"A":    {"C", "D"},
+	"B":    {"C"},
+	"C":    {},
+	"D":    {},
+}
+
+func TestGatherLevels(t *testing.T) {
+	tests := []struct {
+		targets []string
+		levels  map[string]int
+	}{
+		{[]string{"C"}, map[string]int{"C": 0, "A": 1, "B": 1, "root": 2}},
+		{[]string{"D"}, map[string]int{"D": 0, "A": 1, "root": 2}},
+		{[]string{"C", "D"}, map[string]int{"C": 0, "D": 0, "A": 1, "B": 1, "root": 2}},
+		{[]string{"B"}, map[string]int{"B": 0, "root": 1}},
+	}
+	for _, test := range tests {
+		_, lst, err := Gather(testSource(diamond), test.targets...)
+		if err != nil {
+			t.Fatalf("%v: %s", test.targets, err)
+		}
+		levels := map[string]int{}
+		for _, todo := range lst {
+			levels[todo.Name] = todo.Level
+		}
+		if !reflect.DeepEqual(levels, test.levels) {
+			t.Errorf("%v: got levels %v, expected %v", test.targets, levels, test.levels)
+		}
+		for i := 1; i < len(lst); i++ {
+			if lst[i].Less(lst[i-1]) {
+				t.Errorf("%v: todo list not sorted: %s before %s", test.targets, lst[i-1].Name, lst[i].Name)
+			}
+		}
+	}
+}
+
+func TestGatherTargets(t *testing.T) {
+	_, lst, err := Gather(testSource(diamond), "C", "D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"C": "C", "D": "D", "A": "C D", "B": "C", "root": "C D"}
+	got := map[string]string{}
+	for _, todo := range lst {
+		str, err := todo.Format("$targets")
+		if err != nil {
+			t.Fatalf("%s: %s", todo.Name, err)
+		}
+		if string(str) != strings.Join(todo.Targets, " ") {
+			t.Errorf("%s: $targets is %q, expected %q", todo.Name, str, strings.Join(todo.Targets, " "))
+		}
+		got[todo.Name] = string(str)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got targets %v, expected %v", got, expected)
+	}
+	if targets := lst.Targets(); !reflect.DeepEqual(targets, []string{"C", "D"}) {
+		t.Errorf("got session targets %v, expected [C D]", targets)
+	}
+}
+
+func TestGatherMissing(t *testing.T) {
+	graph := map[string][]string{"root": {"A"}, "A": {"B"}}
+	if _, _, err := Gather(testSource(graph), "A"); err == nil {
+		t.Errorf("expected error for missing package B")
+	}
+	if _, _, err := Gather(testSource(diamond), "nosuchpkg"); err == nil {
+		t.Errorf("expected error for unknown target")
+	}
+}
+
+func TestBubbleList(t *testing.T) {
+	pkgs := Packages{}
+	if _, err := GatherDeps(testSource(diamond), pkgs, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	lst, err := BubbleList(pkgs, "QmC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		Level      int
+		DirectDeps []Hash
+		AlsoUpdate []Hash
+		Indirect   []Hash
+	}
+	sorted := func(hashes []Hash) []Hash {
+		res := append([]Hash{}, hashes...)
+		sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+		return res
+	}
+	got := map[Hash]entry{}
+	prevLevel := 0
+	for _, dep := range lst {
+		if dep.Level < prevLevel {
+			t.Errorf("%s at level %d comes after level %d", dep.Hash, dep.Level, prevLevel)
+		}
+		prevLevel = dep.Level
+		got[dep.Hash] = entry{dep.Level, sorted(dep.DirectDeps), sorted(dep.AlsoUpdate), sorted(dep.IndirectDeps)}
+	}
+	expected := map[Hash]entry{
+		"QmC": {0, []Hash{}, []Hash{}, []Hash{}},
+		"QmA": {1, []Hash{"QmC"}, []Hash{}, []Hash{}},
+		"QmB": {1, []Hash{"QmC"}, []Hash{}, []Hash{}},
+		"":    {2, []Hash{"QmA", "QmB"}, []Hash{}, []Hash{"QmC"}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestUpdateState(t *testing.T) {
+	_, lst, err := Gather(testSource(diamond), "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName, err := lst.CreateMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type state struct {
+		Published bool
+		Ready     bool
+		UnmetDeps []string
+	}
+	check := func(step string, expected map[string]state) {
+		t.Helper()
+		for name, exp := range expected {
+			todo := byName[name]
+			got := state{todo.Published, todo.Ready, todo.UnmetDeps}
+			if !reflect.DeepEqual(got, exp) {
+				t.Errorf("%s: %s: got %+v, expected %+v", step, name, got, exp)
+			}
+		}
+	}
+
+	UpdateState(lst, byName)
+	check("initial", map[string]state{
+		"C":    {false, true, nil},
+		"A":    {false, false, []string{"C"}},
+		"B":    {false, false, []string{"C"}},
+		"root": {false, false, []string{"A", "B"}},
+	})
+
+	byName["C"].NewHash = "QmC2"
+	UpdateState(lst, byName)
+	check("C published", map[string]state{
+		"C":    {true, false, nil},
+		"A":    {false, true, nil},
+		"B":    {false, true, nil},
+		"root": {false, false, []string{"A", "B"}},
+	})
+
+	byName["A"].NewHash = "QmA2"
+	byName["A"].NewDeps = map[string]Hash{"C": "QmC2"}
+	UpdateState(lst, byName)
+	check("A published", map[string]state{
+		"A":    {true, false, nil},
+		"root": {false, false, []string{"B"}},
+	})
+
+	// republishing C invalidates A as it was published against the
+	// old hash
+	byName["C"].NewHash = "QmC3"
+	events := UpdateStateEvents(lst, byName)
+	check("C republished", map[string]state{
+		"C": {true, false, nil},
+		"A": {false, true, nil},
+		"B": {false, true, nil},
+	})
+	if len(events) != 1 || events[0].Event != "invalidated" || events[0].Package != "A" {
+		t.Errorf("C republished: unexpected events %+v", events)
+	}
+
+	// as done by 'published reset'
+	byName["C"].NewHash = ""
+	UpdateState(lst, byName)
+	check("C reset", map[string]state{
+		"C": {false, true, nil},
+		"A": {false, false, []string{"C"}},
+		"B": {false, false, []string{"C"}},
+	})
+}
+
+func TestNext(t *testing.T) {
+	_, lst, err := Gather(testSource(diamond), "C", "D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName, err := lst.CreateMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() string {
+		UpdateState(lst, byName)
+		if todo := lst.Next(); todo != nil {
+			return todo.Name
+		}
+		return ""
+	}
+
+	if name := next(); name != "C" {
+		t.Errorf("initial: got %q, expected C", name)
+	}
+	// C unblocks B, D unblocks nothing as A also needs C
+	if n := byName["C"].Unblocks(lst); n != 1 {
+		t.Errorf("C unblocks %d, expected 1", n)
+	}
+	if n := byName["D"].Unblocks(lst); n != 0 {
+		t.Errorf("D unblocks %d, expected 0", n)
+	}
+
+	byName["C"].NewHash = "QmC2"
+	if name := next(); name != "D" {
+		t.Errorf("C published: got %q, expected D", name)
+	}
+
+	// a module without a local checkout is skipped
+	byName["D"].backend = ModBackend
+	if name := next(); name != "B" {
+		t.Errorf("D without checkout: got %q, expected B", name)
+	}
+
+	for _, name := range []string{"B", "D"} {
+		byName[name].NewHash = Hash("Qm" + name + "2")
+	}
+	byName["A"].NewHash = "QmA2"
+	if name := next(); name != "root" {
+		t.Errorf("all deps published: got %q, expected root", name)
+	}
+	byName["root"].NewHash = "QmRoot"
+	if name := next(); name != "" {
+		t.Errorf("all published: got %q, expected nothing", name)
+	}
+}
+
+func TestScanPublished(t *testing.T) {
+	_, lst, err := Gather(testSource(diamond), "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName, _ := lst.CreateMap()
+	src := &MemSource{Dirs: map[string]*PackageFile{}, LastPubVers: map[string]*LastPubVer{}}
+	for _, todo := range lst {
+		todo.Dir = "/src/" + todo.Name
+		todo.OrigVersion = "1.0.0"
+		todo.others = byName
+		src.Dirs[todo.Dir] = &PackageFile{Name: todo.Name}
+	}
+	// the root is never marked
+	src.LastPubVers["/src/root"] = &LastPubVer{"2.0.0", "QmRoot2"}
+	// an older release is not marked
+	src.LastPubVers["/src/A"] = &LastPubVer{"0.9.0", "QmA0"}
+	// B was never published
+	// C has a new release
+	src.LastPubVers["/src/C"] = &LastPubVer{"1.0.1", "QmC2"}
+	events, errs := lst.ScanPublished(src)
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if len(events) != 1 || events[0].Package != "C" || byName["C"].NewHash != "QmC2" {
+		t.Errorf("expected only C to be marked, got %+v", events)
+	}
+
+	// already marked
+	events, _ = lst.ScanPublished(src)
+	if len(events) != 0 {
+		t.Errorf("C marked again: %+v", events)
+	}
+
+	// other errors are reported
+	delete(src.Dirs, "/src/C")
+	src.LastPubVers["/src/C"] = &LastPubVer{"1.0.2", "QmC3"}
+	events, errs = lst.ScanPublished(src)
+	if len(events) != 0 || len(errs) != 1 {
+		t.Errorf("expected one error and nothing marked, got %+v %v", events, errs)
+	}
+
+	// a missing package.json is reported, a missing lastpubver is not
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte(`{"name": "B"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, todo := range lst {
+		todo.Dir = filepath.Join(dir, "nosuchdir")
+	}
+	byName["B"].Dir = dir
+	_, errs = lst.ScanPublished(&FsSource{})
+	if len(errs) != len(lst)-2 {
+		t.Errorf("expected an error for all but the root and B, got %v", errs)
+	}
+
+	// a truncated lastpubver is reported without stopping the scan
+	for name, lastPubVer := range map[string]string{"A": "1.0.1:", "B": "1.0.1: QmB2\n"} {
+		dir := filepath.Join(t.TempDir(), name)
+		if err := os.MkdirAll(filepath.Join(dir, ".gx"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte(`{"name": "`+name+`"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, ".gx", "lastpubver"), []byte(lastPubVer), 0644); err != nil {
+			t.Fatal(err)
+		}
+		byName[name].Dir = dir
+	}
+	events, errs = TodoList{byName["A"], byName["B"]}.ScanPublished(&FsSource{})
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "A: ") {
+		t.Errorf("expected an error for A, got %v", errs)
+	}
+	if len(events) != 1 || events[0].Package != "B" || byName["B"].NewHash != "QmB2" {
+		t.Errorf("expected only B to be marked, got %+v", events)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	// the hash of the second version of C sorts both after and before
+	// the original one
+	for _, other := range []Hash{"QmC9", "Qm0"} {
+		_, old, err := Gather(testSource(diamond), "C")
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldByName, _ := old.CreateMap()
+		oldByName["C"].NewHash = "QmC2"
+		oldByName["C"].NewVersion = "1.0.1"
+		oldByName["A"].NewHash = "QmA2"
+		oldByName["A"].NewDeps = map[string]Hash{"C": "QmC2"}
+		oldByName["B"].Meta = map[string]string{"pr": "1"}
+		oldByName["root"].Meta = map[string]string{"pr": "2"}
+
+		// B is no longer needed, E is new and a second version of C is now
+		// used by E
+		src := testSource(map[string][]string{
+			"root": {"A", "E"},
+			"A":    {"C", "D"},
+			"E":    {},
+			"C":    {},
+			"D":    {},
+		})
+		src.Packages[other] = &PackageFile{Name: "C", Gx: PackageGx{Dvcsimport: "example.com/C"}}
+		src.Packages["QmE"].GxDependencies = []PackageDep{{Hash: other, Name: "C"}}
+		_, lst, err := Gather(src, "C@all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		summary := lst.Merge(old)
+		expected := MergeSummary{
+			Added:   []string{"C@" + string(other), "E"},
+			Removed: []string{"B"},
+			Changed: []string{"root"},
+		}
+		for _, s := range []*MergeSummary{&summary, &expected} {
+			for _, l := range [][]string{s.Added, s.Removed, s.Changed} {
+				sort.Strings(l)
+			}
+		}
+		if !reflect.DeepEqual(summary, expected) {
+			t.Errorf("%s: got summary %+v, expected %+v", other, summary, expected)
+		}
+
+		byName, _ := lst.CreateMap()
+		// the pinned hash is carried over even though the id changed
+		if c := byName["C@QmC"]; c.NewHash != "QmC2" || c.NewVersion != "1.0.1" {
+			t.Errorf("%s: C@QmC: hash not carried over: %+v", other, c)
+		}
+		if c := byName["C@"+string(other)]; c.NewHash != "" || c.NewVersion != "" {
+			t.Errorf("C@%s: unexpected hash %s", other, c.NewHash)
+		}
+		if a := byName["A"]; a.NewHash != "QmA2" || !reflect.DeepEqual(a.NewDeps, map[string]Hash{"C@QmC": "QmC2"}) {
+			t.Errorf("%s: A: not carried over: %+v", other, a)
+		}
+		if root := byName["root"]; root.Meta["pr"] != "2" {
+			t.Errorf("%s: root: meta not carried over: %+v", other, root.Meta)
+		}
+		UpdateState(lst, byName)
+		if !byName["A"].Published || byName["E"].Ready {
+			t.Errorf("%s: unexpected state after merge: A published %v, E ready %v", other, byName["A"].Published, byName["E"].Ready)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	pkgs := versionedPkgs()
+	hashes := []Hash{}
+	for hash := range pkgs {
+		hashes = append(hashes, hash)
+	}
+	byName := TodoByName{}
+	for hash, id := range pkgs.Ids(hashes) {
+		todo := &Todo{Name: pkgs[hash].Name, OrigHash: hash}
+		if id != todo.Name {
+			todo.Id = id
+		}
+		byName[todo.Key()] = todo
+	}
+	tests := []struct {
+		sel  string
+		hash Hash // empty if an error is expected
+	}{
+		{"B", "QmB"},
+		{"B@QmB", "QmB"},
+		{"B@Q", "QmB"},
+		{"A@QmA1x", "QmA1x"},
+		{"A@QmA2", "QmA2"},
+		{"A@QmA1y", "QmA1y"},
+		// ambiguous
+		{"A", ""},
+		{"A@QmA1", ""},
+		// not found
+		{"C", ""},
+		{"A@QmB", ""},
+	}
+	for _, test := range tests {
+		todo, err := byName.Find(test.sel)
+		switch {
+		case test.hash == "" && err == nil:
+			t.Errorf("%s: expected error, got %s", test.sel, todo.Key())
+		case test.hash != "" && err != nil:
+			t.Errorf("%s: %s", test.sel, err)
+		case test.hash != "" && todo.OrigHash != test.hash:
+			t.Errorf("%s: got %s, expected %s", test.sel, todo.OrigHash, test.hash)
+		}
+	}
+	_, err := byName.Find("A@QmA1")
+	if err == nil || !strings.Contains(err.Error(), "A@QmA1x A@QmA1y") {
+		t.Errorf("A@QmA1: unexpected error: %v", err)
+	}
+	if _, err := byName.FindCurrent("B", "A@QmA2"); err == nil {
+		t.Errorf("FindCurrent: expected error for another package")
+	}
+	if todo, err := byName.FindCurrent("A", "A@QmA2"); err != nil || todo.OrigHash != "QmA2" {
+		t.Errorf("FindCurrent: got %v %v", todo, err)
+	}
+}
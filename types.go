@@ -5,7 +5,9 @@ type Hash string
 type PkgInfo struct {
 	Hash       Hash
 	Name       string
+	Version    string
 	Path       string
+	Dir        string // only set if not in the standard location
 	DirectDeps Packages
 	Deps       Packages // transitive closure of all deps
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Drift compares the package in the directory of v with the state and
+// returns a description of each difference.  For packages that are not
+// marked as published it is only checked that they have not been
+// published since the session was started, see NewRelease.  The root
+// package, which is not expected to be published, and packages
+// without a local checkout are not checked.
+func (v *Todo) Drift(src PackageSource) []string {
+	if v.OrigHash == "" {
+		return nil
+	}
+	dir, ok := v.LocalDir()
+	if !ok {
+		// a go module without a local checkout
+		return nil
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return []string{err.Error()}
+	}
+	pkg, lastPubVer, err := GetPubInfo(src, dir)
+	if v.NewHash == "" {
+		if err != nil && !IsNotPublished(err) {
+			return []string{err.Error()}
+		}
+		if err == nil && v.NewRelease(lastPubVer) {
+			return []string{fmt.Sprintf("published as %s %s but not marked as published", lastPubVer.Version, lastPubVer.Hash)}
+		}
+		return nil
+	}
+	if err != nil {
+		return []string{err.Error()}
+	}
+	diffs := []string{}
+	if lastPubVer.Hash != v.NewHash {
+		diffs = append(diffs, fmt.Sprintf("hash is %s, state has %s", lastPubVer.Hash, v.NewHash))
+	}
+	if lastPubVer.Version != v.NewVersion {
+		diffs = append(diffs, fmt.Sprintf("version is %s, state has %s", lastPubVer.Version, v.NewVersion))
+	}
+	onDisk := map[string]Hash{}
+	for _, dep := range pkg.GxDependencies {
+		if id, ok := v.DepId(dep.Name); ok {
+			onDisk[id] = dep.Hash
+		}
+	}
+	ids := NameSet{}
+	for id := range onDisk {
+		ids.Add(id)
+	}
+	for id := range v.NewDeps {
+		ids.Add(id)
+	}
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+	for _, id := range sorted {
+		hash, have := onDisk[id]
+		newHash, had := v.NewDeps[id]
+		switch {
+		case !have:
+			diffs = append(diffs, fmt.Sprintf("dep %s missing, state has %s", id, newHash))
+		case !had:
+			diffs = append(diffs, fmt.Sprintf("dep %s is %s, not in state", id, hash))
+		case hash != newHash:
+			diffs = append(diffs, fmt.Sprintf("dep %s is %s, state has %s", id, hash, newHash))
+		}
+	}
+	return diffs
+}
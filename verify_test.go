@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDrift(t *testing.T) {
+	dir := t.TempDir()
+	src := &MemSource{
+		Dirs:        map[string]*PackageFile{dir: {Name: "A"}},
+		LastPubVers: map[string]*LastPubVer{},
+	}
+	tests := []struct {
+		desc    string
+		todo    Todo
+		lastPub *LastPubVer
+		drift   bool
+	}{
+		{"unchanged", Todo{OrigHash: "QmA", OrigVersion: "1.0.0"}, &LastPubVer{"1.0.0", "QmA"}, false},
+		{"never published", Todo{OrigHash: "QmA", OrigVersion: "1.0.0"}, nil, false},
+		{"new release", Todo{OrigHash: "QmA", OrigVersion: "1.0.0"}, &LastPubVer{"1.0.1", "QmA2"}, true},
+		{"older release", Todo{OrigHash: "QmA", OrigVersion: "1.0.0"}, &LastPubVer{"0.9.0", "QmA0"}, false},
+		{"unknown version", Todo{OrigHash: "QmA"}, &LastPubVer{"0.9.0", "QmA0"}, true},
+		{"root", Todo{}, &LastPubVer{"0.9.0", "QmRoot"}, false},
+		{"marked", Todo{OrigHash: "QmA", NewHash: "QmA2", NewVersion: "1.0.1"}, &LastPubVer{"1.0.1", "QmA2"}, false},
+		{"marked changed", Todo{OrigHash: "QmA", NewHash: "QmA2", NewVersion: "1.0.1"}, &LastPubVer{"1.0.2", "QmA3"}, true},
+	}
+	for _, test := range tests {
+		todo := test.todo
+		todo.Name, todo.Path, todo.Dir = "A", "example.com/A", dir
+		delete(src.LastPubVers, dir)
+		if test.lastPub != nil {
+			src.LastPubVers[dir] = test.lastPub
+		}
+		diffs := todo.Drift(src)
+		if test.drift != (len(diffs) > 0) {
+			t.Errorf("%s: unexpected drift: %v", test.desc, diffs)
+		}
+	}
+
+	// a go module without a local checkout is not checked
+	todo := Todo{Name: "example.com/A", Path: "example.com/A", OrigHash: "example.com/A@v1.0.0", backend: ModBackend}
+	if diffs := todo.Drift(src); len(diffs) > 0 {
+		t.Errorf("module without a checkout: unexpected drift: %v", diffs)
+	}
+
+	// a lastpubver that can't be read is reported
+	if err := os.Mkdir(filepath.Join(dir, ".gx"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte(`{"name": "A"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"bad", "1.0.1:"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, ".gx/lastpubver"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		todo = Todo{Name: "A", Path: "example.com/A", Dir: dir, OrigHash: "QmA"}
+		if diffs := todo.Drift(&FsSource{}); len(diffs) != 1 {
+			t.Errorf("lastpubver %q: expected an error, got %v", data, diffs)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WatchOnce records any new publishes found in the package directories
+// and returns a line describing each change.  The state is only locked
+// while it is being updated.  If some packages could not be checked
+// the error lists them, after the others are recorded.
+//
+// seen holds the last published hash of each package as of the
+// previous call.  Only the packages whose hash changed since then are
+// considered, so that a package is not marked again after, for
+// example, 'published reset' or 'undo'.  The first call just fills in
+// seen.  A lastpubver that can't be parsed is skipped until the next
+// call as it may be partly written.
+func WatchOnce(seen map[string]Hash) ([]string, error) {
+	defer UnlockState()
+	lst, byName, err := GetTodoLocked()
+	if err != nil {
+		return nil, err
+	}
+	src := NewSource(lst[0].backend, filepath.Dir(os.Getenv("GX_UPDATE_STATE")))
+	changed := TodoList{}
+	for _, todo := range lst {
+		dir, ok := todo.LocalDir()
+		if !ok {
+			continue
+		}
+		hash := Hash("")
+		lastPubVer, err := src.ReadLastPubVer(dir)
+		switch {
+		case err == nil:
+			hash = lastPubVer.Hash
+		case err == BadLastPubVer:
+			// most likely still being written by 'gx release', so
+			// check again next time
+			continue
+		case !IsNotPublished(err):
+			// let ScanPublished report it
+			changed = append(changed, todo)
+			continue
+		}
+		if prev, ok := seen[todo.Key()]; ok && prev != hash {
+			changed = append(changed, todo)
+		}
+		seen[todo.Key()] = hash
+	}
+	events, errs := changed.ScanPublished(src)
+	if len(errs) > 0 {
+		strs := make([]string, len(errs))
+		for i, err := range errs {
+			strs[i] = err.Error()
+		}
+		err = fmt.Errorf("some packages could not be checked:\n  %s", strings.Join(strs, "\n  "))
+	}
+	if len(events) == 0 {
+		return nil, err
+	}
+	marked := make([]string, len(events))
+	for i, event := range events {
+		marked[i] = event.Package
+	}
+	events = append(events, UpdateStateEvents(lst, byName)...)
+	if werr := lst.Write("watch: published "+strings.Join(marked, " "), events...); werr != nil {
+		return nil, werr
+	}
+	ready := 0
+	for _, todo := range lst {
+		if todo.Ready {
+			ready++
+		}
+	}
+	lines := []string{}
+	for _, event := range events {
+		todo := byName[event.Package]
+		switch {
+		case event.Event == "invalidated":
+			lines = append(lines, fmt.Sprintf("%s invalidated", todo.Key()))
+		case todo.Published:
+			lines = append(lines, fmt.Sprintf("%s published %s %s — %d packages now READY", todo.Key(), todo.NewVersion, todo.NewHash, ready))
+		default:
+			lines = append(lines, fmt.Sprintf("%s published %s %s but INVALIDATED, the deps. are not up to date", todo.Key(), todo.NewVersion, todo.NewHash))
+		}
+	}
+	return lines, err
+}
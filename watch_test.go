@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWatchOnce(t *testing.T) {
+	tmp := t.TempDir()
+	fn := filepath.Join(tmp, ".gx-update-state.json")
+	t.Setenv("GX_UPDATE_STATE", fn)
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(tmp, "cache"))
+	_, lst, err := Gather(testSource(diamond), "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(name string, lastPubVer string) {
+		t.Helper()
+		fn := filepath.Join(tmp, name, ".gx", "lastpubver")
+		if err := ioutil.WriteFile(fn, []byte(lastPubVer+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, todo := range lst {
+		todo.Dir = filepath.Join(tmp, todo.Name)
+		if err := os.MkdirAll(filepath.Join(todo.Dir, ".gx"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(todo.Dir, "package.json"), []byte(`{"name": "`+todo.Name+`"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = WriteStateFile(fn, JsonState{Version: StateVersion, Todo: lst}, 0644, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marked := func() []string {
+		t.Helper()
+		lst, _, err := GetTodo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := []string{}
+		for _, todo := range lst {
+			if todo.NewHash != "" {
+				res = append(res, todo.Name)
+			}
+		}
+		return res
+	}
+
+	// C was published before watching started so is not recorded
+	publish("C", "1.0.1: QmC2")
+	seen := map[string]Hash{}
+	lines, err := WatchOnce(seen)
+	if err != nil || len(lines) != 0 {
+		t.Fatalf("first call: got %v %v, expected nothing", lines, err)
+	}
+	if res := marked(); len(res) != 0 {
+		t.Errorf("first call: %v marked", res)
+	}
+
+	// nothing changed
+	lines, err = WatchOnce(seen)
+	if err != nil || len(lines) != 0 {
+		t.Errorf("unchanged: got %v %v, expected nothing", lines, err)
+	}
+
+	publish("B", "1.0.1: QmB2")
+	lines, err = WatchOnce(seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "B published 1.0.1 QmB2") {
+		t.Errorf("B published: unexpected lines %q", lines)
+	}
+	if res := marked(); len(res) != 1 || res[0] != "B" {
+		t.Errorf("B published: got %v marked, expected only B", res)
+	}
+
+	// a partly written lastpubver is retried on the next call
+	publish("A", "1.0.1:")
+	lines, err = WatchOnce(seen)
+	if err != nil || len(lines) != 0 {
+		t.Errorf("partly written: got %v %v, expected nothing", lines, err)
+	}
+	publish("A", "1.0.1: QmA2")
+	lines, err = WatchOnce(seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "A published 1.0.1 QmA2") {
+		t.Errorf("A published: unexpected lines %q", lines)
+	}
+}